@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitDateLayouts are the date formats accepted in GIT_AUTHOR_DATE and
+// GIT_COMMITTER_DATE besides git's internal "<unix seconds> <offset>".
+var gitDateLayouts = []string{
+	time.RFC1123Z,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05 -0700",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// parseGitDate turns a date from the environment into git's internal
+// "<unix seconds> <offset>" format.
+func parseGitDate(date string) (string, error) {
+	date = strings.TrimSpace(date)
+	seconds, offset, ok := strings.Cut(strings.TrimPrefix(date, "@"), " ")
+	if _, err := strconv.ParseInt(seconds, 10, 64); err == nil {
+		if !ok {
+			offset = "+0000"
+		}
+		if _, err := time.Parse("-0700", offset); err != nil {
+			return "", fmt.Errorf("invalid date format: %s", date)
+		}
+		return seconds + " " + offset, nil
+	}
+	for _, layout := range gitDateLayouts {
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return fmt.Sprintf("%d %s", t.Unix(), t.Format("-0700")), nil
+		}
+	}
+	return "", fmt.Errorf("invalid date format: %s", date)
+}
+
+// identity returns the "Name <email> <date>" line for role, which is
+// "AUTHOR" or "COMMITTER", from the GIT_<role>_* environment variables,
+// falling back to user.name and user.email and the current time.
+func identity(repoPath, role string) (string, error) {
+	name := os.Getenv("GIT_" + role + "_NAME")
+	if name == "" {
+		name = lookupConfig(repoPath, "user.name")
+	}
+	email := os.Getenv("GIT_" + role + "_EMAIL")
+	if email == "" {
+		email = lookupConfig(repoPath, "user.email")
+	}
+	if name == "" || email == "" {
+		return "", errors.New(strings.ToLower(role[:1]) + strings.ToLower(role[1:]) +
+			" identity unknown; set user.name and user.email, or GIT_" + role + "_NAME and GIT_" + role + "_EMAIL")
+	}
+	// angle brackets and newlines would corrupt the header
+	if strings.ContainsAny(name, "<>\n") || strings.ContainsAny(email, "<>\n") {
+		return "", fmt.Errorf("invalid %s identity: %s <%s>", strings.ToLower(role), name, email)
+	}
+	date := fmt.Sprintf("%d %s", time.Now().Unix(), time.Now().Format("-0700"))
+	if envDate := os.Getenv("GIT_" + role + "_DATE"); envDate != "" {
+		var err error
+		if date, err = parseGitDate(envDate); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%s <%s> %s", name, email, date), nil
+}
+
+// serializeCommit encodes a commit object with the given tree, parents,
+// author and committer lines and message.
+func serializeCommit(treeSha string, parents []string, author, committer, msg string) []byte {
+	sb := strings.Builder{}
+	sb.WriteString("tree " + treeSha + "\n")
+	for _, parent := range parents {
+		sb.WriteString("parent " + parent + "\n")
+	}
+	sb.WriteString("author " + author + "\n")
+	sb.WriteString("committer " + committer + "\n")
+	sb.WriteString("\n" + msg)
+	return []byte(sb.String())
+}
+
+// Commit is a parsed commit object.
+type Commit struct {
+	tree      string
+	parents   []string
+	author    string
+	committer string
+	message   string
+}
+
+// readCommit reads and parses the commit object sha.
+func readCommit(repoPath, sha string) (*Commit, error) {
+	objReader, err := NewGitObjectReader(repoPath, sha)
+	if err != nil {
+		return nil, err
+	}
+	defer objReader.Close()
+	if objReader.Type != "commit" {
+		return nil, fmt.Errorf("object %s is a %s, not a commit", sha, objReader.Type)
+	}
+	contents, err := objReader.ReadContents()
+	if err != nil {
+		return nil, err
+	}
+	header, message, _ := strings.Cut(string(contents), "\n\n")
+	commit := &Commit{message: message}
+	for _, line := range strings.Split(header, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			commit.tree = value
+		case "parent":
+			commit.parents = append(commit.parents, value)
+		case "author":
+			commit.author = value
+		case "committer":
+			commit.committer = value
+		}
+	}
+	if !isObjectSha(commit.tree) {
+		return nil, fmt.Errorf("invalid commit object %s", sha)
+	}
+	return commit, nil
+}
+
+// commitTime returns the committer timestamp in seconds since the epoch,
+// or 0 when the committer line has none.
+func (c *Commit) commitTime() int64 {
+	fields := strings.Fields(c.committer)
+	if len(fields) < 2 {
+		return 0
+	}
+	seconds, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return seconds
+}
+
+// isAncestor reports whether the commit ancestor is reachable from the
+// commit sha. Parents missing from a shallow repository end the walk.
+func isAncestor(repoPath, ancestor, sha string) (bool, error) {
+	seen := map[string]bool{sha: true}
+	pending := []string{sha}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if current == ancestor {
+			return true, nil
+		}
+		commit, err := readCommit(repoPath, current)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, parent := range commit.parents {
+			if !seen[parent] {
+				seen[parent] = true
+				pending = append(pending, parent)
+			}
+		}
+	}
+	return false, nil
+}
+
+// resolveCommit resolves rev and checks that it names a commit.
+func resolveCommit(repoPath, rev string) (string, error) {
+	sha, err := resolveRevision(repoPath, rev)
+	if err != nil {
+		return "", err
+	}
+	objReader, err := NewGitObjectReader(repoPath, sha)
+	if err != nil {
+		return "", err
+	}
+	objReader.Close()
+	if objReader.Type != "commit" {
+		return "", fmt.Errorf("%s is a %s, not a commit", rev, objReader.Type)
+	}
+	return sha, nil
+}
+
+// appendMessage adds the paragraph given with -m or the contents of the
+// file given with -F to msg, separating it from earlier ones with a blank
+// line. A -F of "-" reads standard input.
+func appendMessage(msg *strings.Builder, opt, value string) error {
+	if msg.Len() > 0 {
+		msg.WriteString("\n")
+	}
+	if opt == "-m" {
+		msg.WriteString(value)
+		if !strings.HasSuffix(value, "\n") {
+			msg.WriteString("\n")
+		}
+		return nil
+	}
+	var contents []byte
+	var err error
+	if value == "-" {
+		contents, err = io.ReadAll(os.Stdin)
+	} else {
+		contents, err = os.ReadFile(value)
+	}
+	msg.Write(contents)
+	return err
+}
+
+// cleanupMessage strips trailing whitespace from every line, collapses
+// runs of blank lines and removes leading and trailing blank lines, as git
+// commit does with messages given on the command line.
+func cleanupMessage(msg string) string {
+	lines := []string{}
+	blank := false
+	for _, line := range strings.Split(msg, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func commitTree(args []string) int {
+	treeRev := ""
+	parents := []string{}
+	var msg strings.Builder
+	hasMessage := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "-p", "-m", "-F":
+			if i+1 >= len(args) {
+				fmt.Fprintf(os.Stderr, "option %s requires a value\n", arg)
+				return 1
+			}
+			i++
+		}
+		switch arg {
+		case "-p":
+			parent, err := resolveCommit(".", args[i])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				return 1
+			}
+			duplicate := false
+			for _, p := range parents {
+				duplicate = duplicate || p == parent
+			}
+			if duplicate {
+				fmt.Fprintf(os.Stderr, "error: duplicate parent %s ignored\n", parent)
+				continue
+			}
+			parents = append(parents, parent)
+		case "-m", "-F":
+			if err := appendMessage(&msg, arg, args[i]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading message: %s\n", err)
+				return 1
+			}
+			hasMessage = true
+		default:
+			if strings.HasPrefix(arg, "-") || treeRev != "" {
+				fmt.Fprintf(os.Stderr, "usage: mygit commit-tree <tree> [(-p <parent>)...] [(-m <message>)...] [(-F <file>)...]\n")
+				return 1
+			}
+			treeRev = arg
+		}
+	}
+	if treeRev == "" {
+		fmt.Fprintf(os.Stderr, "usage: mygit commit-tree <tree> [(-p <parent>)...] [(-m <message>)...] [(-F <file>)...]\n")
+		return 1
+	}
+	treeSha, err := resolveRevision(".", treeRev)
+	if err == nil {
+		treeSha, err = peelToTree(".", treeSha)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	if !hasMessage {
+		contents, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading message: %s\n", err)
+			return 1
+		}
+		msg.Write(contents)
+	}
+
+	author, err := identity(".", "AUTHOR")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	committer, err := identity(".", "COMMITTER")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	_, sha := writeObject("commit", serializeCommit(treeSha, parents, author, committer, msg.String()))
+	fmt.Println(sha)
+	return 0
+}
+
+// commitIndex records the index as a new commit on top of HEAD and moves
+// the branch HEAD refers to, or HEAD itself when it is detached.
+func commitIndex(args []string) int {
+	var msg strings.Builder
+	hasMessage, allowEmpty := false, false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "-m", "-F":
+			if i+1 >= len(args) {
+				fmt.Fprintf(os.Stderr, "option %s requires a value\n", arg)
+				return 1
+			}
+			i++
+			if err := appendMessage(&msg, arg, args[i]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading message: %s\n", err)
+				return 1
+			}
+			hasMessage = true
+		case "--allow-empty":
+			allowEmpty = true
+		default:
+			fmt.Fprintf(os.Stderr, "usage: mygit commit [--allow-empty] (-m <message> | -F <file>)...\n")
+			return 1
+		}
+	}
+	if !hasMessage {
+		fmt.Fprintf(os.Stderr, "Error: a commit message is required, use -m or -F\n")
+		return 1
+	}
+	message := cleanupMessage(msg.String())
+	if message == "" {
+		fmt.Fprintf(os.Stderr, "Aborting commit due to empty commit message.\n")
+		return 1
+	}
+
+	branch, err := readSymbolicRef(".", "HEAD")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading HEAD: %s\n", err)
+		return 1
+	}
+	parents := []string{}
+	headTree := ""
+	headSha, err := readRef(".", "HEAD")
+	if err == nil {
+		if headTree, err = peelToTree(".", headSha); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading HEAD commit: %s\n", err)
+			return 1
+		}
+		parents = append(parents, headSha)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "Error reading HEAD: %s\n", err)
+		return 1
+	}
+	// readIndex treats a missing index as empty, which is only right on an
+	// unborn branch; on top of HEAD it would commit the deletion of every file
+	if len(parents) > 0 {
+		if _, err := os.Stat(indexPath(".")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot read index: %s, refusing to commit on top of HEAD\n", err)
+			return 1
+		}
+	}
+
+	idx, err := readIndex(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading index: %s\n", err)
+		return 1
+	}
+	treeSha, err := idx.writeTree()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	if err := idx.write("."); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing index: %s\n", err)
+		return 1
+	}
+	if !allowEmpty && (treeSha == headTree || (headTree == "" && len(idx.entries) == 0)) {
+		fmt.Println("nothing to commit, working tree clean")
+		return 1
+	}
+
+	author, err := identity(".", "AUTHOR")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	committer, err := identity(".", "COMMITTER")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	_, sha := writeObject("commit", serializeCommit(treeSha, parents, author, committer, message))
+
+	ref, label := branch, strings.TrimPrefix(branch, "refs/heads/")
+	if branch == "" {
+		ref, label = "HEAD", "detached HEAD"
+	}
+	if err := updateRef(".", ref, sha); err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating %s: %s\n", ref, err)
+		return 1
+	}
+	if len(parents) == 0 {
+		label += " (root-commit)"
+	}
+	subject, _, _ := strings.Cut(message, "\n")
+	fmt.Printf("[%s %s] %s\n", label, sha[:7], subject)
+	return 0
+}
@@ -0,0 +1,899 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const maxConfigIncludeDepth = 10
+
+// ConfigEntry is one variable assignment read from a config file. line is
+// the zero-based line on which the assignment starts and lineCount the
+// number of lines it spans, so that the writer can replace it in place.
+type ConfigEntry struct {
+	section    string
+	subsection string
+	key        string
+	value      string
+	hasValue   bool
+	file       string
+	line       int
+	lineCount  int
+	column     int
+}
+
+// ConfigSection records where a section header is and the line after the
+// last assignment that belongs to it, where new variables are inserted.
+type ConfigSection struct {
+	section    string
+	subsection string
+	line       int
+	end        int
+}
+
+// Config holds the variables of one or more config files in the order in
+// which git reads them, so that later entries override earlier ones.
+type Config struct {
+	entries    []*ConfigEntry
+	sections   []*ConfigSection
+	repoPath   string
+	noIncludes bool
+}
+
+// name returns the canonical name of the variable, with the section and
+// the key lowercased.
+func (e *ConfigEntry) name() string {
+	if e.subsection == "" {
+		return e.section + "." + e.key
+	}
+	return e.section + "." + e.subsection + "." + e.key
+}
+
+// parseConfigName splits a variable name such as "remote.origin.url" into
+// its section, subsection and key. Only the subsection is case sensitive.
+func parseConfigName(name string) (section, subsection, key string, err error) {
+	first := strings.IndexByte(name, '.')
+	last := strings.LastIndexByte(name, '.')
+	if first <= 0 {
+		return "", "", "", fmt.Errorf("key does not contain a section: %s", name)
+	}
+	if last == len(name)-1 {
+		return "", "", "", fmt.Errorf("key does not contain variable name: %s", name)
+	}
+	section, key = strings.ToLower(name[:first]), strings.ToLower(name[last+1:])
+	if first != last {
+		subsection = name[first+1 : last]
+	}
+	if !isConfigKey(key) {
+		return "", "", "", fmt.Errorf("invalid key: %s", name)
+	}
+	return section, subsection, key, nil
+}
+
+func isConfigKey(key string) bool {
+	if key == "" || !isAlpha(key[0]) {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if !isAlpha(key[i]) && !isDigit(key[i]) && key[i] != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// configParser reads the INI-like syntax of git config files.
+type configParser struct {
+	data   string
+	pos    int
+	line   int
+	column int
+	file   string
+}
+
+func (p *configParser) peek() byte {
+	if p.pos >= len(p.data) {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+func (p *configParser) next() byte {
+	c := p.peek()
+	if p.pos < len(p.data) {
+		p.pos++
+		p.column++
+		if c == '\n' {
+			p.line++
+			p.column = 0
+		}
+	}
+	return c
+}
+
+func (p *configParser) errorf() error {
+	return fmt.Errorf("bad config line %d in file %s", p.line+1, p.file)
+}
+
+// parseSectionHeader reads "[section]", "[section "subsection"]" or the
+// deprecated "[section.subsection]" after the opening bracket.
+func (p *configParser) parseSectionHeader() (section, subsection string, err error) {
+	var sb strings.Builder
+	for {
+		c := p.next()
+		switch {
+		case c == ']':
+			name := sb.String()
+			if name == "" {
+				return "", "", p.errorf()
+			}
+			section, subsection, _ = strings.Cut(name, ".")
+			return strings.ToLower(section), strings.ToLower(subsection), nil
+		case c == ' ' || c == '\t':
+			for p.peek() == ' ' || p.peek() == '\t' {
+				p.next()
+			}
+			if p.next() != '"' || sb.Len() == 0 {
+				return "", "", p.errorf()
+			}
+			var sub strings.Builder
+			for {
+				c := p.next()
+				if c == 0 || c == '\n' {
+					return "", "", p.errorf()
+				}
+				if c == '"' {
+					break
+				}
+				if c == '\\' {
+					c = p.next()
+					if c == 0 || c == '\n' {
+						return "", "", p.errorf()
+					}
+				}
+				sub.WriteByte(c)
+			}
+			if p.next() != ']' {
+				return "", "", p.errorf()
+			}
+			return strings.ToLower(sb.String()), sub.String(), nil
+		case isAlpha(c) || isDigit(c) || c == '-' || c == '.':
+			sb.WriteByte(c)
+		default:
+			return "", "", p.errorf()
+		}
+	}
+}
+
+// parseValue reads a value after the '=' up to the end of the line,
+// removing quotes, comments and surrounding whitespace and following
+// escaped newlines.
+func (p *configParser) parseValue() (string, error) {
+	var sb strings.Builder
+	quoted := false
+	spaces := 0
+	for {
+		c := p.peek()
+		if c == 0 || c == '\n' {
+			if quoted {
+				return "", p.errorf()
+			}
+			return sb.String(), nil
+		}
+		p.next()
+		if !quoted && (c == ';' || c == '#') {
+			for p.peek() != 0 && p.peek() != '\n' {
+				p.next()
+			}
+			continue
+		}
+		if !quoted && (c == ' ' || c == '\t' || c == '\r') {
+			if sb.Len() > 0 {
+				spaces++
+			}
+			continue
+		}
+		for ; spaces > 0; spaces-- {
+			sb.WriteByte(' ')
+		}
+		switch c {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			switch escaped := p.next(); escaped {
+			case '\n':
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'b':
+				sb.WriteByte('\b')
+			case '\\', '"':
+				sb.WriteByte(escaped)
+			default:
+				return "", p.errorf()
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+// parseConfig parses the contents of a config file, appending its entries
+// and sections to c. include is called for every include.path and
+// includeIf.<condition>.path entry right after it is added.
+func (c *Config) parseConfig(data, file string, include func(entry *ConfigEntry) error) error {
+	p := &configParser{data: data, file: file}
+	var current *ConfigSection
+	for {
+		ch := p.peek()
+		switch {
+		case ch == 0:
+			return nil
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			p.next()
+		case ch == '#' || ch == ';':
+			for p.peek() != 0 && p.peek() != '\n' {
+				p.next()
+			}
+		case ch == '[':
+			line := p.line
+			p.next()
+			section, subsection, err := p.parseSectionHeader()
+			if err != nil {
+				return err
+			}
+			current = &ConfigSection{section: section, subsection: subsection, line: line, end: p.line + 1}
+			c.sections = append(c.sections, current)
+		case isAlpha(ch):
+			if current == nil {
+				return p.errorf()
+			}
+			entry := &ConfigEntry{
+				section:    current.section,
+				subsection: current.subsection,
+				file:       file,
+				line:       p.line,
+				column:     p.column,
+			}
+			var key strings.Builder
+			for isAlpha(p.peek()) || isDigit(p.peek()) || p.peek() == '-' {
+				key.WriteByte(p.next())
+			}
+			entry.key = strings.ToLower(key.String())
+			for p.peek() == ' ' || p.peek() == '\t' || p.peek() == '\r' {
+				p.next()
+			}
+			switch p.peek() {
+			case '=':
+				p.next()
+				value, err := p.parseValue()
+				if err != nil {
+					return err
+				}
+				entry.value, entry.hasValue = value, true
+			case 0, '\n', '#', ';':
+				for p.peek() != 0 && p.peek() != '\n' {
+					p.next()
+				}
+			default:
+				return p.errorf()
+			}
+			entry.lineCount = p.line - entry.line + 1
+			current.end = p.line + 1
+			c.entries = append(c.entries, entry)
+			if include != nil && (entry.section == "include" || entry.section == "includeif") && entry.key == "path" {
+				if err := include(entry); err != nil {
+					return err
+				}
+			}
+		default:
+			return p.errorf()
+		}
+	}
+}
+
+// includeApplies evaluates the condition of an [includeIf] section.
+func (c *Config) includeApplies(condition, file string) bool {
+	kind, pattern, ok := strings.Cut(condition, ":")
+	if !ok || pattern == "" {
+		return false
+	}
+	var subject, prefix string
+	switch kind {
+	case "gitdir", "gitdir/i":
+		gitDir, err := filepath.Abs(path.Join(c.repoPath, ".git"))
+		if err != nil || c.repoPath == "" {
+			return false
+		}
+		subject = filepath.ToSlash(gitDir)
+		pattern = expandHome(pattern)
+		if strings.HasPrefix(pattern, "./") {
+			pattern = path.Join(filepath.ToSlash(filepath.Dir(file)), pattern)
+		} else if !path.IsAbs(pattern) {
+			pattern = "**/" + pattern
+		}
+		if kind == "gitdir/i" {
+			prefix = "(?i)"
+		}
+	case "onbranch":
+		if c.repoPath == "" {
+			return false
+		}
+		branch, err := readSymbolicRef(c.repoPath, "HEAD")
+		if err != nil || !strings.HasPrefix(branch, "refs/heads/") {
+			return false
+		}
+		subject = strings.TrimPrefix(branch, "refs/heads/")
+	default:
+		return false
+	}
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	re, err := regexp.Compile(prefix + globToRegexp(pattern))
+	return err == nil && re.MatchString(subject)
+}
+
+// readFile parses the config file at filePath and the files it includes.
+// A missing file is not an error.
+func (c *Config) readFile(filePath string, depth int) error {
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.parseConfig(string(data), filePath, func(entry *ConfigEntry) error {
+		if c.noIncludes {
+			return nil
+		}
+		if !entry.hasValue {
+			return fmt.Errorf("missing value for '%s'", entry.name())
+		}
+		if entry.section == "includeif" && !c.includeApplies(entry.subsection, filePath) {
+			return nil
+		}
+		if depth+1 >= maxConfigIncludeDepth {
+			return fmt.Errorf("exceeded maximum include depth (%d) while including %s", maxConfigIncludeDepth, entry.value)
+		}
+		includePath := expandHome(entry.value)
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(filePath), includePath)
+		}
+		return c.readFile(includePath, depth+1)
+	})
+}
+
+// configScopeFiles returns the files of the system, global and local
+// scopes, in the order in which they are read.
+func configScopeFiles(repoPath string) map[string][]string {
+	system := "/etc/gitconfig"
+	if env := os.Getenv("GIT_CONFIG_SYSTEM"); env != "" {
+		system = env
+	}
+	scopes := map[string][]string{"system": {system}}
+	if os.Getenv("GIT_CONFIG_NOSYSTEM") != "" {
+		scopes["system"] = nil
+	}
+	if env := os.Getenv("GIT_CONFIG_GLOBAL"); env != "" {
+		scopes["global"] = []string{env}
+	} else {
+		global := []string{}
+		if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+			global = append(global, filepath.Join(xdg, "git", "config"))
+		} else if home, err := os.UserHomeDir(); err == nil {
+			global = append(global, filepath.Join(home, ".config", "git", "config"))
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			global = append(global, filepath.Join(home, ".gitconfig"))
+		}
+		scopes["global"] = global
+	}
+	if repoPath != "" {
+		scopes["local"] = []string{path.Join(repoPath, ".git", "config")}
+	}
+	return scopes
+}
+
+// loadConfig reads the system, global and local configuration of the
+// repository at repoPath; repoPath "" reads only the first two.
+func loadConfig(repoPath string) (*Config, error) {
+	c := &Config{repoPath: repoPath}
+	scopes := configScopeFiles(repoPath)
+	for _, scope := range []string{"system", "global", "local"} {
+		for _, file := range scopes[scope] {
+			if err := c.readFile(file, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// find returns the entries assigning the variable name, in file order.
+func (c *Config) find(name string) ([]*ConfigEntry, error) {
+	section, subsection, key, err := parseConfigName(name)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*ConfigEntry{}
+	for _, entry := range c.entries {
+		if entry.section == section && entry.subsection == subsection && entry.key == key {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// get returns the last value of the variable name. A variable without
+// "=" has the value "", and true is returned with it.
+func (c *Config) get(name string) (string, bool) {
+	entries, err := c.find(name)
+	if err != nil || len(entries) == 0 {
+		return "", false
+	}
+	return entries[len(entries)-1].value, true
+}
+
+// getAll returns every value of the multi-valued variable name.
+func (c *Config) getAll(name string) []string {
+	entries, _ := c.find(name)
+	values := []string{}
+	for _, entry := range entries {
+		values = append(values, entry.value)
+	}
+	return values
+}
+
+// lookupConfig returns the value of the configuration variable name, such
+// as "user.email", or "" when it is not set or the configuration cannot
+// be read.
+func lookupConfig(repoPath, name string) string {
+	c, err := loadConfig(repoPath)
+	if err != nil {
+		return ""
+	}
+	value, _ := c.get(name)
+	return value
+}
+
+// formatConfigValue quotes and escapes value so that parseValue reads it
+// back unchanged.
+func formatConfigValue(value string) string {
+	quote := strings.ContainsAny(value, ";#") || strings.TrimSpace(value) != value
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\b':
+			sb.WriteString(`\b`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if quote {
+		return `"` + sb.String() + `"`
+	}
+	return sb.String()
+}
+
+// formatSectionHeader returns the header line starting a section.
+func formatSectionHeader(section, subsection string) string {
+	if subsection == "" {
+		return "[" + section + "]"
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(subsection)
+	return "[" + section + ` "` + escaped + `"]`
+}
+
+// ConfigFile is a single config file being edited. Edits keep the layout
+// and comments of the lines they do not touch.
+type ConfigFile struct {
+	path   string
+	lines  []string
+	config *Config
+}
+
+var errConfigMultipleValues = errors.New("multiple values")
+
+func openConfigFile(filePath string) (*ConfigFile, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f := &ConfigFile{path: filePath, config: &Config{}}
+	if err := f.config.parseConfig(string(data), filePath, nil); err != nil {
+		return nil, err
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if text != "" {
+		f.lines = strings.Split(text, "\n")
+	}
+	return f, nil
+}
+
+// assignment returns the line for entry's key set to value, keeping any
+// section header that shares the line with the old assignment.
+func (f *ConfigFile) assignment(entry *ConfigEntry, key, value string) string {
+	prefix := f.lines[entry.line][:entry.column]
+	if strings.TrimSpace(prefix) == "" {
+		prefix = "\t"
+	}
+	return prefix + key + " = " + formatConfigValue(value)
+}
+
+// replaceLines swaps lines [start, end) for replacement and reparses the
+// file so that line numbers stay accurate.
+func (f *ConfigFile) replaceLines(start, end int, replacement ...string) error {
+	lines := append([]string{}, f.lines[:start]...)
+	lines = append(lines, replacement...)
+	f.lines = append(lines, f.lines[end:]...)
+	f.config = &Config{}
+	return f.config.parseConfig(strings.Join(f.lines, "\n")+"\n", f.path, nil)
+}
+
+// set assigns value to name. With add the value is appended to the
+// existing ones; with replaceAll all existing values are replaced by it.
+// Without either, a variable with several values is left untouched and
+// errConfigMultipleValues is returned.
+func (f *ConfigFile) set(name, value string, add, replaceAll bool) error {
+	section, subsection, _, err := parseConfigName(name)
+	if err != nil {
+		return err
+	}
+	key := name[strings.LastIndexByte(name, '.')+1:]
+	entries, _ := f.config.find(name)
+	if len(entries) > 1 && !add && !replaceAll {
+		return errConfigMultipleValues
+	}
+	if len(entries) > 0 && !add {
+		// with replaceAll, drop all but the last value and overwrite it
+		for i := len(entries) - 2; i >= 0; i-- {
+			if err := f.replaceLines(entries[i].line, entries[i].line+entries[i].lineCount); err != nil {
+				return err
+			}
+		}
+		entries, _ = f.config.find(name)
+		last := entries[len(entries)-1]
+		return f.replaceLines(last.line, last.line+last.lineCount, f.assignment(last, key, value))
+	}
+	var target *ConfigSection
+	for _, s := range f.config.sections {
+		if s.section == section && s.subsection == subsection {
+			target = s
+		}
+	}
+	line := "\t" + key + " = " + formatConfigValue(value)
+	if target == nil {
+		sectionName := name[:strings.IndexByte(name, '.')]
+		return f.replaceLines(len(f.lines), len(f.lines), formatSectionHeader(sectionName, subsection), line)
+	}
+	return f.replaceLines(target.end, target.end, line)
+}
+
+// unset removes name. Without all, a variable with several values is left
+// untouched and errConfigMultipleValues is returned. It reports whether
+// anything was removed.
+func (f *ConfigFile) unset(name string, all bool) (bool, error) {
+	entries, err := f.config.find(name)
+	if err != nil {
+		return false, err
+	}
+	if len(entries) > 1 && !all {
+		return false, errConfigMultipleValues
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.column > 0 && strings.TrimSpace(f.lines[entry.line][:entry.column]) != "" {
+			// keep the section header sharing the line
+			err = f.replaceLines(entry.line, entry.line+entry.lineCount, strings.TrimRight(f.lines[entry.line][:entry.column], " \t"))
+		} else {
+			err = f.replaceLines(entry.line, entry.line+entry.lineCount)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(entries) > 0 {
+		if err := f.removeEmptySection(entries[0].section, entries[0].subsection); err != nil {
+			return false, err
+		}
+	}
+	return len(entries) > 0, nil
+}
+
+// removeEmptySection drops the header of the given section when nothing
+// but blank lines is left in it, as git does after unsetting its last
+// variable.
+func (f *ConfigFile) removeEmptySection(section, subsection string) error {
+	sections := f.config.sections
+	for i := len(sections) - 1; i >= 0; i-- {
+		s := sections[i]
+		if s.section != section || s.subsection != subsection {
+			continue
+		}
+		end := len(f.lines)
+		if i+1 < len(sections) {
+			end = sections[i+1].line
+		}
+		// a header followed by an assignment on the same line is kept
+		if !strings.HasSuffix(strings.TrimSpace(f.lines[s.line]), "]") {
+			continue
+		}
+		empty := true
+		for _, line := range f.lines[s.line+1 : end] {
+			empty = empty && strings.TrimSpace(line) == ""
+		}
+		if empty {
+			if err := f.replaceLines(s.line, end); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// write saves the file through a lock file.
+func (f *ConfigFile) write() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	lockPath := f.path + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("could not lock config file %s: %w", f.path, err)
+	}
+	writer := bufio.NewWriter(lock)
+	for _, line := range f.lines {
+		writer.WriteString(line + "\n")
+	}
+	err = writer.Flush()
+	if closeErr := lock.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	return os.Rename(lockPath, f.path)
+}
+
+// setConfig assigns value to name in the repository's local config file.
+func setConfig(repoPath, name, value string) error {
+	f, err := openConfigFile(path.Join(repoPath, ".git", "config"))
+	if err != nil {
+		return err
+	}
+	if err := f.set(name, value, false, false); err != nil {
+		return err
+	}
+	return f.write()
+}
+
+func config(args []string) int {
+	scope, file := "", ""
+	action := ""
+	all := false
+	// includes are followed by default only when reading every scope
+	includes := -1
+	names := []string{}
+	setAction := func(a string) bool {
+		if action != "" && action != a {
+			fmt.Fprintf(os.Stderr, "error: only one action at a time\n")
+			return false
+		}
+		action = a
+		return true
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		ok := true
+		switch arg {
+		case "--local", "--global", "--system":
+			scope = strings.TrimPrefix(arg, "--")
+		case "-f", "--file":
+			if i+1 >= len(args) {
+				fmt.Fprintf(os.Stderr, "option %s requires a value\n", arg)
+				return 129
+			}
+			i++
+			scope, file = "file", args[i]
+		case "--get":
+			ok = setAction("get")
+		case "--get-all":
+			ok = setAction("get")
+			all = true
+		case "--unset":
+			ok = setAction("unset")
+		case "--unset-all":
+			ok = setAction("unset")
+			all = true
+		case "--add":
+			ok = setAction("add")
+		case "--replace-all":
+			ok = setAction("set")
+			all = true
+		case "-l", "--list":
+			ok = setAction("list")
+		case "--all":
+			all = true
+		case "--includes":
+			includes = 1
+		case "--no-includes":
+			includes = 0
+		default:
+			if strings.HasPrefix(arg, "-") {
+				fmt.Fprintf(os.Stderr, "error: unknown option `%s'\n", strings.TrimLeft(arg, "-"))
+				return 129
+			}
+			if action == "" && len(names) == 0 && (arg == "get" || arg == "set" || arg == "unset" || arg == "list") {
+				action = arg
+				continue
+			}
+			names = append(names, arg)
+		}
+		if !ok {
+			return 129
+		}
+	}
+	if action == "" {
+		action = "get"
+		if len(names) == 2 {
+			action = "set"
+		}
+	}
+	wantArgs := map[string]int{"get": 1, "set": 2, "add": 2, "unset": 1, "list": 0}[action]
+	if len(names) != wantArgs {
+		fmt.Fprintf(os.Stderr, "usage: mygit config [--local | --global | --system | -f <file>] [get [--all] <name> | set [--all] <name> <value> | unset [--all] <name> | list]\n")
+		return 129
+	}
+
+	// outside a repository only the system and global files are used
+	repoPath := "."
+	if _, err := os.Stat(".git"); err != nil {
+		repoPath = ""
+	}
+	scopes := configScopeFiles(repoPath)
+	if action == "list" || action == "get" {
+		c := &Config{repoPath: repoPath, noIncludes: includes == 0 || (includes == -1 && scope != "")}
+		var err error
+		switch scope {
+		case "":
+			if c.noIncludes {
+				for _, scope := range []string{"system", "global", "local"} {
+					for _, f := range scopes[scope] {
+						if err == nil {
+							err = c.readFile(f, 0)
+						}
+					}
+				}
+				break
+			}
+			c, err = loadConfig(repoPath)
+		case "file":
+			err = c.readFile(file, 0)
+		default:
+			for _, f := range scopes[scope] {
+				if err = c.readFile(f, 0); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+			return 128
+		}
+		writer := bufio.NewWriter(os.Stdout)
+		defer writer.Flush()
+		if action == "list" {
+			for _, entry := range c.entries {
+				if entry.hasValue {
+					fmt.Fprintf(writer, "%s=%s\n", entry.name(), entry.value)
+				} else {
+					fmt.Fprintln(writer, entry.name())
+				}
+			}
+			return 0
+		}
+		entries, err := c.find(names[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return 1
+		}
+		if len(entries) == 0 {
+			return 1
+		}
+		if !all {
+			entries = entries[len(entries)-1:]
+		}
+		for _, entry := range entries {
+			fmt.Fprintln(writer, entry.value)
+		}
+		return 0
+	}
+
+	target := file
+	switch scope {
+	case "", "local":
+		local, ok := scopes["local"]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "fatal: not in a git directory\n")
+			return 128
+		}
+		target = local[0]
+	case "system":
+		system := scopes["system"]
+		if len(system) == 0 {
+			fmt.Fprintf(os.Stderr, "fatal: system config is disabled by GIT_CONFIG_NOSYSTEM\n")
+			return 128
+		}
+		target = system[0]
+	case "global":
+		// like git, prefer ~/.gitconfig unless only the XDG file exists
+		global := scopes["global"]
+		if len(global) == 0 {
+			fmt.Fprintf(os.Stderr, "fatal: $HOME not set\n")
+			return 128
+		}
+		target = global[len(global)-1]
+		if _, err := os.Stat(target); os.IsNotExist(err) && len(global) > 1 {
+			if _, err := os.Stat(global[0]); err == nil {
+				target = global[0]
+			}
+		}
+	}
+	f, err := openConfigFile(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		return 128
+	}
+	switch action {
+	case "set", "add":
+		err = f.set(names[0], names[1], action == "add", all)
+	case "unset":
+		var removed bool
+		removed, err = f.unset(names[0], all)
+		if err == nil && !removed {
+			return 5
+		}
+	}
+	if errors.Is(err, errConfigMultipleValues) {
+		fmt.Fprintf(os.Stderr, "warning: %s has multiple values\n", names[0])
+		if action == "set" {
+			fmt.Fprintf(os.Stderr, "error: cannot overwrite multiple values with a single value\n")
+			fmt.Fprintf(os.Stderr, "       Use --add or --replace-all to change %s.\n", names[0])
+		}
+		return 5
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	if err := f.write(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 4
+	}
+	return 0
+}
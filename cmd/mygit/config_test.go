@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitExitCode runs the git command line in dir and returns its exit code.
+func gitExitCode(t *testing.T, dir string, args ...string) int {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+func TestConfigEditsMatchGit(t *testing.T) {
+	requireGit(t)
+	setGitEnv(t)
+
+	initial := `# a comment that is kept
+[core]
+	repositoryformatversion = 0
+	bare = false ; trailing comment
+[remote "origin"]
+	url = https://example.com/repo.git
+	fetch = +refs/heads/*:refs/remotes/origin/*
+[branch "main"]
+	remote = origin
+`
+	dir := t.TempDir()
+	ours, theirs := filepath.Join(dir, "ours"), filepath.Join(dir, "theirs")
+	for _, file := range []string{ours, theirs} {
+		if err := os.WriteFile(file, []byte(initial), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each step edits ours and runs the matching git config command on
+	// theirs; wantError is the error expected when git exits with status 5
+	steps := []struct {
+		git       []string
+		add       bool
+		replace   bool
+		unset     bool
+		all       bool
+		name      string
+		value     string
+		wantError error
+	}{
+		{git: []string{"core.bare", "true"}, name: "core.bare", value: "true"},
+		{git: []string{"core.editor", "vim -f"}, name: "core.editor", value: "vim -f"},
+		{git: []string{"--add", "remote.origin.fetch", "+refs/tags/*:refs/tags/*"}, add: true, name: "remote.origin.fetch", value: "+refs/tags/*:refs/tags/*"},
+		{git: []string{"--add", "remote.origin.fetch", "+refs/notes/*:refs/notes/*"}, add: true, name: "remote.origin.fetch", value: "+refs/notes/*:refs/notes/*"},
+		{git: []string{"remote.origin.fetch", "x"}, name: "remote.origin.fetch", value: "x", wantError: errConfigMultipleValues},
+		{git: []string{"--unset", "remote.origin.fetch"}, unset: true, name: "remote.origin.fetch", wantError: errConfigMultipleValues},
+		{git: []string{"--replace-all", "remote.origin.fetch", "+refs/heads/main:refs/remotes/origin/main"}, replace: true, name: "remote.origin.fetch", value: "+refs/heads/main:refs/remotes/origin/main"},
+		{git: []string{"--add", "remote.origin.fetch", "+refs/heads/next:refs/remotes/origin/next"}, add: true, name: "remote.origin.fetch", value: "+refs/heads/next:refs/remotes/origin/next"},
+		{git: []string{"--unset-all", "remote.origin.fetch"}, unset: true, all: true, name: "remote.origin.fetch"},
+		{git: []string{"branch.Main.remote", "upstream"}, name: "branch.Main.remote", value: "upstream"},
+		{git: []string{"BRANCH.main.REMOTE", "fork"}, name: "BRANCH.main.REMOTE", value: "fork"},
+		{git: []string{`branch.a "quoted\ name.merge`, "refs/heads/a"}, name: `branch.a "quoted\ name.merge`, value: "refs/heads/a"},
+		{git: []string{"user.name", " padded; with # comment chars\\ "}, name: "user.name", value: " padded; with # comment chars\\ "},
+		{git: []string{"--unset", "branch.Main.remote"}, unset: true, name: "branch.Main.remote"},
+	}
+	for _, step := range steps {
+		f, err := openConfigFile(ours)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if step.unset {
+			_, err = f.unset(step.name, step.all)
+		} else {
+			err = f.set(step.name, step.value, step.add, step.replace)
+		}
+		if err == nil {
+			err = f.write()
+		}
+		if !errors.Is(err, step.wantError) {
+			t.Fatalf("%s: got error %v, want %v", strings.Join(step.git, " "), err, step.wantError)
+		}
+
+		code := gitExitCode(t, dir, append([]string{"config", "--file", theirs}, step.git...)...)
+		if wantCode := map[bool]int{true: 5, false: 0}[step.wantError != nil]; code != wantCode {
+			t.Fatalf("git config %s exited with %d, want %d", strings.Join(step.git, " "), code, wantCode)
+		}
+
+		got, _ := os.ReadFile(ours)
+		want, _ := os.ReadFile(theirs)
+		if string(got) != string(want) {
+			t.Fatalf("after %s the file is\n%s\nwant\n%s", strings.Join(step.git, " "), got, want)
+		}
+	}
+
+	c := &Config{}
+	if err := c.readFile(ours, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"core.bare", "core.editor", "branch.main.remote", `branch.a "quoted\ name.merge`, "user.name"} {
+		want := strings.TrimSuffix(string(runGitInput(t, dir, "", "config", "--file", theirs, "--get", name)), "\n")
+		if got, _ := c.get(name); got != want {
+			t.Errorf("%s is %q, git reads %q", name, got, want)
+		}
+	}
+}
+
+func TestConfigIncludeCycle(t *testing.T) {
+	requireGit(t)
+	setGitEnv(t)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"a": "[include]\n\tpath = b\n[user]\n\tname = a\n",
+		"b": "[include]\n\tpath = a\n[user]\n\temail = b@example.com\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Config{}
+	err := c.readFile(filepath.Join(dir, "a"), 0)
+	if err == nil || !strings.Contains(err.Error(), "exceeded maximum include depth") {
+		t.Errorf("got error %v for an include cycle", err)
+	}
+	if code := gitExitCode(t, dir, "config", "--file", "a", "--includes", "--list"); code == 0 {
+		t.Errorf("git config accepted the include cycle")
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Refspec maps remote refs to local ones, as in
+// "+refs/heads/*:refs/remotes/origin/*". A "*" in the source matches any
+// part of a ref name, which replaces the "*" of the destination. force
+// allows updates that are not fast-forwards. A push refspec with an empty
+// source deletes its destination.
+type Refspec struct {
+	force bool
+	src   string
+	dst   string
+}
+
+func parseRefspec(spec string) (*Refspec, error) {
+	r := &Refspec{}
+	rest, force := strings.CutPrefix(spec, "+")
+	r.force = force
+	r.src, r.dst, _ = strings.Cut(rest, ":")
+	srcGlobs, dstGlobs := strings.Count(r.src, "*"), strings.Count(r.dst, "*")
+	if (r.src == "" && r.dst == "") || srcGlobs > 1 || dstGlobs > 1 || (r.dst != "" && srcGlobs != dstGlobs) {
+		return nil, fmt.Errorf("invalid refspec '%s'", spec)
+	}
+	return r, nil
+}
+
+func (r *Refspec) isGlob() bool {
+	return strings.Contains(r.src, "*")
+}
+
+// match reports whether the glob source of r matches the ref name and
+// returns the local ref name maps to, or "" when r has no destination.
+func (r *Refspec) match(name string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(r.src, "*")
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	if r.dst == "" {
+		return "", true
+	}
+	dstPrefix, dstSuffix, _ := strings.Cut(r.dst, "*")
+	return dstPrefix + name[len(prefix):len(name)-len(suffix)] + dstSuffix, true
+}
+
+// refPrefixes returns the ref prefixes to ask the server for to find the
+// refs r may match.
+func (r *Refspec) refPrefixes() []string {
+	if prefix, _, ok := strings.Cut(r.src, "*"); ok {
+		return []string{prefix}
+	}
+	return expandRefName(r.src)
+}
+
+// fetchedRef is an advertised ref a fetch stores in the local ref local,
+// or only in FETCH_HEAD when local is "". merge marks the refs FETCH_HEAD
+// offers for merging.
+type fetchedRef struct {
+	remote RemoteRef
+	local  string
+	force  bool
+	merge  bool
+}
+
+// shortRefName strips the namespace off a ref name, as in
+// "refs/remotes/origin/main" giving "origin/main".
+func shortRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if short, ok := strings.CutPrefix(name, prefix); ok {
+			return short
+		}
+	}
+	return name
+}
+
+// displayUrl shortens a repository url the way git shows it in fetch
+// output and FETCH_HEAD, without trailing slashes and ".git".
+func displayUrl(gitUrl string) string {
+	return strings.TrimSuffix(strings.TrimRight(gitUrl, "/"), ".git")
+}
+
+// fetchHeadLine formats the FETCH_HEAD entry for ref, such as
+// "<oid>\t\tbranch 'main' of https://host/repo".
+func fetchHeadLine(ref fetchedRef, gitUrl string) string {
+	marker := "not-for-merge"
+	if ref.merge {
+		marker = ""
+	}
+	note := ""
+	switch name := ref.remote.name; {
+	case name == "HEAD":
+	case strings.HasPrefix(name, "refs/heads/"):
+		note = fmt.Sprintf("branch '%s' of ", strings.TrimPrefix(name, "refs/heads/"))
+	case strings.HasPrefix(name, "refs/tags/"):
+		note = fmt.Sprintf("tag '%s' of ", strings.TrimPrefix(name, "refs/tags/"))
+	case strings.HasPrefix(name, "refs/remotes/"):
+		note = fmt.Sprintf("remote-tracking branch '%s' of ", strings.TrimPrefix(name, "refs/remotes/"))
+	default:
+		note = fmt.Sprintf("'%s' of ", name)
+	}
+	return fmt.Sprintf("%s\t%s\t%s%s\n", ref.remote.sha, marker, note, displayUrl(gitUrl))
+}
+
+// fetchResult is one line of the fetch summary, such as
+// " * [new branch]      main       -> origin/main".
+type fetchResult struct {
+	code    byte
+	summary string
+	from    string
+	to      string
+	note    string
+}
+
+// updateFetchedRef stores ref in its local ref and describes the update.
+// Branches only move forward unless the update is forced, and existing
+// tags are never moved unless forced. ok is false when the update was
+// rejected.
+func updateFetchedRef(repoPath string, ref fetchedRef) (result fetchResult, ok bool, err error) {
+	result = fetchResult{from: shortRefName(ref.remote.name), to: shortRefName(ref.local)}
+	newSha := ref.remote.sha
+	oldSha, err := readRef(repoPath, ref.local)
+	if err != nil {
+		result.code = '*'
+		switch {
+		case strings.HasPrefix(ref.remote.name, "refs/tags/"):
+			result.summary = "[new tag]"
+		case strings.HasPrefix(ref.remote.name, "refs/heads/"):
+			result.summary = "[new branch]"
+		default:
+			result.summary = "[new ref]"
+		}
+		return result, true, updateRef(repoPath, ref.local, newSha)
+	}
+	if oldSha == newSha {
+		return fetchResult{}, true, nil
+	}
+
+	if strings.HasPrefix(ref.local, "refs/tags/") {
+		if !ref.force {
+			result.code, result.summary, result.note = '!', "[rejected]", "would clobber existing tag"
+			return result, false, nil
+		}
+		result.code, result.summary = 't', "[tag update]"
+		return result, true, updateRef(repoPath, ref.local, newSha)
+	}
+	// tags, trees and blobs cannot fast-forward, so an error here only
+	// means the update needs to be forced
+	fastForward, err := isAncestor(repoPath, oldSha, newSha)
+	switch {
+	case err == nil && fastForward:
+		result.code, result.summary = ' ', oldSha[:7]+".."+newSha[:7]
+	case ref.force:
+		result.code, result.summary, result.note = '+', oldSha[:7]+"..."+newSha[:7], "forced update"
+	default:
+		result.code, result.summary, result.note = '!', "[rejected]", "non-fast-forward"
+		return result, false, nil
+	}
+	return result, true, updateRef(repoPath, ref.local, newSha)
+}
+
+func fetch(args []string) int {
+	force, quiet, allTags, noTags := false, false, false, false
+	positional := []string{}
+	for _, arg := range args {
+		switch arg {
+		case "-f", "--force":
+			force = true
+		case "-q", "--quiet":
+			quiet = true
+		case "-t", "--tags":
+			allTags = true
+		case "-n", "--no-tags":
+			noTags = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				fmt.Fprintf(os.Stderr, "Unknown option %s\n", arg)
+				return 129
+			}
+			positional = append(positional, arg)
+		}
+	}
+
+	cfg, err := loadConfig(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		return 128
+	}
+	currentBranch, err := readSymbolicRef(".", "HEAD")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading HEAD: %s\n", err)
+		return 128
+	}
+	branchRemote, _ := cfg.get("branch." + strings.TrimPrefix(currentBranch, "refs/heads/") + ".remote")
+	remoteName := "origin"
+	if len(positional) > 0 {
+		remoteName = positional[0]
+	} else if currentBranch != "" && branchRemote != "" {
+		remoteName = branchRemote
+	}
+	gitUrl, isRemote := cfg.get("remote." + remoteName + ".url")
+	if !isRemote {
+		if !strings.Contains(remoteName, "://") {
+			fmt.Fprintf(os.Stderr, "fatal: '%s' does not appear to be a git repository\n", remoteName)
+			return 128
+		}
+		gitUrl = remoteName
+	}
+
+	configured := []*Refspec{}
+	for _, spec := range cfg.getAll("remote." + remoteName + ".fetch") {
+		refspec, err := parseRefspec(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+			return 128
+		}
+		configured = append(configured, refspec)
+	}
+	fromCommandLine := len(positional) > 1
+	refspecs := configured
+	if fromCommandLine {
+		refspecs = []*Refspec{}
+		for _, spec := range positional[1:] {
+			refspec, err := parseRefspec(spec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+				return 128
+			}
+			// an empty source, as in ":refs/heads/copy", stands for HEAD
+			if refspec.src == "" {
+				refspec.src = "HEAD"
+			}
+			refspecs = append(refspecs, refspec)
+		}
+	} else if len(refspecs) == 0 {
+		// a remote without fetch refspecs gives its HEAD to FETCH_HEAD
+		refspecs = []*Refspec{{src: "HEAD"}}
+		fromCommandLine = true
+	}
+	if allTags {
+		refspecs = append(refspecs, &Refspec{src: "refs/tags/*", dst: "refs/tags/*"})
+	}
+	// the branch "git pull" would merge is marked for merging in FETCH_HEAD
+	mergeRef := ""
+	if !fromCommandLine && currentBranch != "" && branchRemote == remoteName {
+		mergeRef, _ = cfg.get("branch." + strings.TrimPrefix(currentBranch, "refs/heads/") + ".merge")
+	}
+	followTags := !noTags && !allTags
+
+	prefixes := []string{}
+	for _, refspec := range refspecs {
+		prefixes = append(prefixes, refspec.refPrefixes()...)
+	}
+	if followTags {
+		prefixes = append(prefixes, "refs/tags/")
+	}
+	adv, err := fetchRefAdvertisement(gitUrl, prefixes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading refs of %s: %s\n", gitUrl, err)
+		return 128
+	}
+
+	fetched := []fetchedRef{}
+	addRef := func(ref fetchedRef) {
+		for _, existing := range fetched {
+			if existing.remote.name == ref.remote.name && existing.local == ref.local {
+				return
+			}
+		}
+		ref.force = ref.force || force
+		fetched = append(fetched, ref)
+	}
+	for _, refspec := range refspecs {
+		if refspec.isGlob() {
+			for _, ref := range adv.refs {
+				if local, ok := refspec.match(ref.name); ok {
+					addRef(fetchedRef{remote: ref, local: local, force: refspec.force, merge: ref.name == mergeRef})
+				}
+			}
+			continue
+		}
+		var ref *RemoteRef
+		for _, candidate := range expandRefName(refspec.src) {
+			if ref = adv.find(candidate); ref != nil {
+				break
+			}
+		}
+		if ref == nil {
+			fmt.Fprintf(os.Stderr, "fatal: couldn't find remote ref %s\n", refspec.src)
+			return 128
+		}
+		local := refspec.dst
+		if local != "" && !strings.HasPrefix(local, "refs/") {
+			if strings.HasPrefix(ref.name, "refs/tags/") {
+				local = "refs/tags/" + local
+			} else {
+				local = "refs/heads/" + local
+			}
+		}
+		addRef(fetchedRef{remote: *ref, local: local, force: refspec.force, merge: fromCommandLine || ref.name == mergeRef})
+		if !fromCommandLine || !isRemote {
+			continue
+		}
+		// like git, a ref fetched by name also updates its remote-tracking ref
+		for _, c := range configured {
+			if tracking, ok := c.match(ref.name); ok && c.isGlob() && tracking != "" {
+				addRef(fetchedRef{remote: *ref, local: tracking, force: c.force})
+			}
+		}
+	}
+	for _, ref := range fetched {
+		if ref.local != "" && ref.local == currentBranch {
+			cwd, _ := filepath.Abs(".")
+			fmt.Fprintf(os.Stderr, "fatal: refusing to fetch into branch '%s' checked out at '%s'\n", ref.local, cwd)
+			return 128
+		}
+	}
+
+	// tags pointing into the fetched history are fetched too, those whose
+	// objects are already local right away and the others by include-tag
+	tagCandidates := []RemoteRef{}
+	if followTags {
+		for _, ref := range adv.refs {
+			if !strings.HasPrefix(ref.name, "refs/tags/") {
+				continue
+			}
+			if _, err := readRef(".", ref.name); err == nil {
+				continue
+			}
+			tagCandidates = append(tagCandidates, ref)
+		}
+	}
+	wants := []string{}
+	for _, ref := range fetched {
+		if !hasObject(".", ref.remote.sha) && !slices.Contains(wants, ref.remote.sha) {
+			wants = append(wants, ref.remote.sha)
+		}
+	}
+	for _, tag := range tagCandidates {
+		target := tag.sha
+		if tag.peeled != "" {
+			target = tag.peeled
+		}
+		if hasObject(".", target) && !hasObject(".", tag.sha) && !slices.Contains(wants, tag.sha) {
+			wants = append(wants, tag.sha)
+		}
+	}
+	if len(wants) > 0 {
+		shallow, err := readShallow(".")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading shallow commits: %s\n", err)
+			return 128
+		}
+		req := &FetchRequest{wants: wants, shallow: shallow, includeTags: followTags}
+		if !quiet {
+			req.progress = os.Stderr
+		}
+		if err := fetchObjects(".", gitUrl, adv, req); err != nil {
+			fmt.Fprintf(os.Stderr, "Error fetching objects: %s\n", err)
+			return 128
+		}
+	}
+	for _, tag := range tagCandidates {
+		if hasObject(".", tag.sha) {
+			addRef(fetchedRef{remote: tag, local: tag.name})
+		}
+	}
+
+	fetchHead := strings.Builder{}
+	written := []string{}
+	for _, merge := range []bool{true, false} {
+		for _, ref := range fetched {
+			if ref.merge == merge && !slices.Contains(written, ref.remote.name) {
+				fetchHead.WriteString(fetchHeadLine(ref, gitUrl))
+				written = append(written, ref.remote.name)
+			}
+		}
+	}
+	if err := os.WriteFile(path.Join(".git", "FETCH_HEAD"), []byte(fetchHead.String()), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing FETCH_HEAD: %s\n", err)
+		return 128
+	}
+
+	exitCode := 0
+	results := []fetchResult{}
+	for _, ref := range fetched {
+		if ref.local == "" {
+			result := fetchResult{code: '*', summary: "branch", from: shortRefName(ref.remote.name), to: "FETCH_HEAD"}
+			if strings.HasPrefix(ref.remote.name, "refs/tags/") {
+				result.summary = "tag"
+			}
+			results = append(results, result)
+			continue
+		}
+		result, ok, err := updateFetchedRef(".", ref)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot update ref '%s': %s\n", ref.local, err)
+			exitCode = 1
+			continue
+		}
+		if !ok {
+			exitCode = 1
+		}
+		if result.code != 0 {
+			results = append(results, result)
+		}
+	}
+	if quiet || len(results) == 0 {
+		return exitCode
+	}
+
+	width := 10
+	for _, result := range results {
+		width = max(width, len(result.from))
+	}
+	fmt.Fprintf(os.Stderr, "From %s\n", displayUrl(gitUrl))
+	for _, result := range results {
+		line := fmt.Sprintf(" %c %-17s %-*s -> %s", result.code, result.summary, width, result.from, result.to)
+		if result.note != "" {
+			line += "  (" + result.note + ")"
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+	return exitCode
+}
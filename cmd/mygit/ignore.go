@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnorePattern is one line of a gitignore file compiled into a regular
+// expression. base is the directory of the .gitignore file the pattern
+// comes from, relative to the repository root.
+type IgnorePattern struct {
+	re       *regexp.Regexp
+	text     string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	base     string
+	source   string
+	line     int
+}
+
+// IgnoreMatcher decides which working tree paths are ignored, using
+// core.excludesFile, .git/info/exclude and the .gitignore file of every
+// directory, in increasing order of precedence.
+type IgnoreMatcher struct {
+	repoPath string
+	global   []*IgnorePattern
+	perDir   map[string][]*IgnorePattern
+}
+
+// posixClasses are the names allowed in a "[:name:]" character class.
+var posixClasses = map[string]bool{
+	"alnum": true, "alpha": true, "blank": true, "cntrl": true,
+	"digit": true, "graph": true, "lower": true, "print": true,
+	"punct": true, "space": true, "upper": true, "xdigit": true,
+}
+
+// bracketToRegexp translates the bracket expression at the start of glob
+// into a regular expression class and returns it with the length of the
+// expression. ok is false when the expression is not closed.
+func bracketToRegexp(glob string) (class string, n int, ok bool) {
+	var sb strings.Builder
+	sb.WriteString("[")
+	i := 1
+	if i < len(glob) && (glob[i] == '!' || glob[i] == '^') {
+		// like in git, a negated set never matches a '/'
+		sb.WriteString("^/")
+		i++
+	}
+	for start := i; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == ']' && i > start:
+			sb.WriteString("]")
+			return sb.String(), i + 1, true
+		case strings.HasPrefix(glob[i:], "[:"):
+			end := strings.Index(glob[i+2:], ":]")
+			if end >= 0 && posixClasses[glob[i+2:i+2+end]] {
+				sb.WriteString(glob[i : i+end+4])
+				i += end + 3
+				continue
+			}
+			sb.WriteString(`\[`)
+		case c == '\\' && i+1 < len(glob):
+			i++
+			if strings.IndexByte(`\[]^-`, glob[i]) >= 0 {
+				sb.WriteString(`\`)
+			}
+			sb.WriteByte(glob[i])
+		case c == '[' || c == ']' || c == '\\':
+			sb.WriteString(`\` + string(c))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", 0, false
+}
+
+// globToRegexp translates the wildcards of a gitignore pattern into a
+// regular expression matching whole paths.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "**" && i > 0 && glob[i-1] == '/':
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			for i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+			}
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			class, n, ok := bracketToRegexp(glob[i:])
+			if !ok {
+				// like in git, a pattern with an unclosed '[' never matches
+				return `[^\x00-\x{10FFFF}]`
+			}
+			sb.WriteString(class)
+			i += n - 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// parseIgnorePattern compiles a line of a gitignore file. It returns nil
+// for blank lines, comments and patterns that cannot be compiled.
+func parseIgnorePattern(line, base, source string, lineNum int) *IgnorePattern {
+	line = strings.TrimRight(line, "\r")
+	// trailing spaces are ignored unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	pattern := &IgnorePattern{text: line, base: base, source: source, line: lineNum}
+	glob := line
+	if strings.HasPrefix(glob, "!") {
+		pattern.negate = true
+		glob = glob[1:]
+	} else if strings.HasPrefix(glob, `\!`) || strings.HasPrefix(glob, `\#`) {
+		glob = glob[1:]
+	}
+	if strings.HasSuffix(glob, "/") {
+		pattern.dirOnly = true
+		glob = strings.TrimRight(glob, "/")
+	}
+	if glob == "" {
+		return nil
+	}
+	if strings.Contains(glob, "/") {
+		pattern.anchored = true
+		glob = strings.TrimPrefix(glob, "/")
+	}
+	re, err := regexp.Compile(globToRegexp(glob))
+	if err != nil {
+		return nil
+	}
+	pattern.re = re
+	return pattern
+}
+
+func readIgnoreFile(filePath, base, source string) ([]*IgnorePattern, error) {
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	patterns := []*IgnorePattern{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if pattern := parseIgnorePattern(scanner.Text(), base, source, lineNum); pattern != nil {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// expandHome replaces a leading "~/" with the home directory.
+func expandHome(p string) string {
+	if rest, ok := strings.CutPrefix(p, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return p
+}
+
+// defaultExcludesFile returns where git looks for the user's ignore rules
+// when core.excludesFile is not set.
+func defaultExcludesFile() string {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "git", "ignore")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config", "git", "ignore")
+	}
+	return ""
+}
+
+func newIgnoreMatcher(repoPath string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{
+		repoPath: repoPath,
+		perDir:   make(map[string][]*IgnorePattern),
+	}
+	excludesFile := lookupConfig(repoPath, "core.excludesFile")
+	source := excludesFile
+	if excludesFile == "" {
+		excludesFile = defaultExcludesFile()
+		source = excludesFile
+	}
+	if excludesFile != "" {
+		patterns, err := readIgnoreFile(expandHome(excludesFile), "", source)
+		if err != nil {
+			return nil, err
+		}
+		m.global = append(m.global, patterns...)
+	}
+	patterns, err := readIgnoreFile(path.Join(repoPath, ".git", "info", "exclude"), "", ".git/info/exclude")
+	if err != nil {
+		return nil, err
+	}
+	m.global = append(m.global, patterns...)
+	return m, nil
+}
+
+// dirPatterns returns the patterns of the .gitignore file in dir, which is
+// relative to the repository root, loading it on first use.
+func (m *IgnoreMatcher) dirPatterns(dir string) []*IgnorePattern {
+	if patterns, ok := m.perDir[dir]; ok {
+		return patterns
+	}
+	source := path.Join(dir, ".gitignore")
+	// an unreadable .gitignore is treated like a missing one
+	patterns, _ := readIgnoreFile(filepath.Join(m.repoPath, filepath.FromSlash(source)), dir, source)
+	m.perDir[dir] = patterns
+	return patterns
+}
+
+func (p *IgnorePattern) matches(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	rel := name
+	if p.base != "" {
+		rel = strings.TrimPrefix(name, p.base+"/")
+	}
+	if !p.anchored {
+		rel = path.Base(rel)
+	}
+	return p.re.MatchString(rel)
+}
+
+// lastMatch returns the pattern with the highest precedence matching name
+// itself, without looking at its parent directories, or nil.
+func (m *IgnoreMatcher) lastMatch(name string, isDir bool) *IgnorePattern {
+	dirs := []string{""}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		patterns := m.dirPatterns(dirs[i])
+		for j := len(patterns) - 1; j >= 0; j-- {
+			if patterns[j].matches(name, isDir) {
+				return patterns[j]
+			}
+		}
+	}
+	for j := len(m.global) - 1; j >= 0; j-- {
+		if m.global[j].matches(name, isDir) {
+			return m.global[j]
+		}
+	}
+	return nil
+}
+
+// match returns the pattern deciding whether name is ignored. A path
+// inside an ignored directory is ignored by the pattern excluding that
+// directory, since git never re-includes files of excluded directories.
+func (m *IgnoreMatcher) match(name string, isDir bool) *IgnorePattern {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '/' {
+			continue
+		}
+		if pattern := m.lastMatch(name[:i], true); pattern != nil && !pattern.negate {
+			return pattern
+		}
+	}
+	return m.lastMatch(name, isDir)
+}
+
+// isIgnored reports whether the path name, relative to the repository
+// root, is ignored.
+func (m *IgnoreMatcher) isIgnored(name string, isDir bool) bool {
+	pattern := m.match(name, isDir)
+	return pattern != nil && !pattern.negate
+}
+
+func checkIgnore(args []string) int {
+	verbose, nonMatching, noIndex := false, false, false
+	paths := []string{}
+	for _, arg := range args {
+		switch arg {
+		case "-v", "--verbose":
+			verbose = true
+		case "-n", "--non-matching":
+			nonMatching = true
+		case "--no-index":
+			noIndex = true
+		case "--":
+		default:
+			if strings.HasPrefix(arg, "-") {
+				fmt.Fprintf(os.Stderr, "Unknown option %s\n", arg)
+				return 1
+			}
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: mygit check-ignore [-v] [-n] [--no-index] <pathname>...\n")
+		return 1
+	}
+	if nonMatching && !verbose {
+		fmt.Fprintf(os.Stderr, "--non-matching is only valid with --verbose\n")
+		return 1
+	}
+	matcher, err := newIgnoreMatcher(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading ignore files: %s\n", err)
+		return 1
+	}
+	idx := &Index{}
+	if !noIndex {
+		if idx, err = readIndex("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading index: %s\n", err)
+			return 1
+		}
+	}
+
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+	exitCode := 1
+	for _, arg := range paths {
+		name, err := normalizePathspec(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		isDir := strings.HasSuffix(arg, "/")
+		if info, err := os.Lstat(filepath.FromSlash(name)); err == nil && info.IsDir() {
+			isDir = true
+		}
+		var pattern *IgnorePattern
+		// tracked files are never ignored
+		if _, tracked := idx.find(name); !tracked {
+			pattern = matcher.match(name, isDir)
+		}
+		// like git, a negated match counts as a match when it is shown
+		if pattern != nil && (verbose || !pattern.negate) {
+			exitCode = 0
+		}
+		switch {
+		case verbose && pattern != nil:
+			fmt.Fprintf(writer, "%s:%d:%s\t%s\n", pattern.source, pattern.line, pattern.text, arg)
+		case verbose && nonMatching:
+			fmt.Fprintf(writer, "::\t%s\n", arg)
+		case pattern != nil && !pattern.negate:
+			fmt.Fprintln(writer, arg)
+		}
+	}
+	return exitCode
+}
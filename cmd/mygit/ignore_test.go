@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreMatchesGit(t *testing.T) {
+	requireGit(t)
+	setGitEnv(t)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	// every case gets its own directory and .gitignore; paths ending in
+	// "/" are directories
+	cases := []struct {
+		gitignore string
+		paths     []string
+	}{
+		{"*.o", []string{"a.o", "sub/a.o", "a.c", "a.o/"}},
+		{"/build", []string{"build", "build/", "sub/build"}},
+		{"build/", []string{"build", "build/", "sub/build/"}},
+		{"doc/*.txt", []string{"doc/a.txt", "doc/sub/a.txt", "a.txt"}},
+		{"**/logs", []string{"logs", "a/logs", "a/b/logs/"}},
+		{"logs/**", []string{"logs/a", "logs/a/b", "logs"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b", "b"}},
+		{"x/a*b", []string{"x/ab", "x/axxb", "x/a/b"}},
+		{"foo?", []string{"foo1", "foo", "foo12"}},
+		{"[[:digit:]]*.log", []string{"1.log", "12.log", "a.log"}},
+		{"file[[:upper:][:digit:]]", []string{"fileA", "file1", "filea"}},
+		{"v[[:alpha:]0-9_]", []string{"va", "v5", "v_", "v-"}},
+		{"x[!a-c]", []string{"xd", "xa", "xc"}},
+		{"d/x[!a]y", []string{"d/xby", "d/xay", "d/x/y"}},
+		{"x[]a]", []string{"x]", "xa", "xb"}},
+		{`x[\-a]`, []string{"x-", "xa", "xb"}},
+		{"x[a-c]y", []string{"xby", "xdy"}},
+		{"x[ab", []string{"x[ab", "xa"}},
+		{"*.log\n!keep.log", []string{"keep.log", "a.log"}},
+		{"dir/\n!dir/keep", []string{"dir/keep", "dir/other"}},
+		{`\#hash` + "\n" + `\!bang`, []string{"#hash", "!bang"}},
+		{"spaces   \n" + `trail\ `, []string{"spaces", "trail ", "trail"}},
+	}
+
+	repo := t.TempDir()
+	runGit(t, repo, "init", "-q")
+	names := []string{}
+	for i, c := range cases {
+		dir := fmt.Sprintf("c%d", i)
+		if err := os.MkdirAll(filepath.Join(repo, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo, dir, ".gitignore"), []byte(c.gitignore+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range c.paths {
+			names = append(names, dir+"/"+p)
+		}
+	}
+
+	out := runGitInput(t, repo, strings.Join(names, "\n")+"\n", "check-ignore", "--no-index", "--stdin")
+	ignoredByGit := make(map[string]bool)
+	for _, name := range strings.Split(string(out), "\n") {
+		ignoredByGit[name] = true
+	}
+
+	matcher, err := newIgnoreMatcher(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		isDir := strings.HasSuffix(name, "/")
+		got := matcher.isIgnored(strings.TrimSuffix(name, "/"), isDir)
+		if want := ignoredByGit[name]; got != want {
+			dir, _, _ := strings.Cut(name, "/")
+			gitignore, _ := os.ReadFile(filepath.Join(repo, dir, ".gitignore"))
+			t.Errorf("%s with %q: ignored is %t, git says %t", name, gitignore, got, want)
+		}
+	}
+}
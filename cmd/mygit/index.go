@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	indexFlagAssumeValid = 0x8000
+	indexFlagExtended    = 0x4000
+	indexFlagStageMask   = 0x3000
+	indexFlagStageShift  = 12
+	indexFlagNameMask    = 0x0fff
+
+	indexFlagIntentToAdd = 0x2000
+
+	indexModeRegular    = 0100644
+	indexModeExecutable = 0100755
+	indexModeSymlink    = 0120000
+	indexModeGitlink    = 0160000
+)
+
+var indexSignature = []byte("DIRC")
+
+// IndexEntry is one staged path of .git/index, with the stat data that is
+// used to tell whether the working tree file changed since it was staged.
+type IndexEntry struct {
+	ctimeSec      uint32
+	ctimeNsec     uint32
+	mtimeSec      uint32
+	mtimeNsec     uint32
+	dev           uint32
+	ino           uint32
+	mode          uint32
+	uid           uint32
+	gid           uint32
+	size          uint32
+	sha           string
+	flags         uint16
+	extendedFlags uint16
+	name          string
+}
+
+// IndexExtension is an extension section of the index kept as raw data.
+type IndexExtension struct {
+	signature string
+	data      []byte
+}
+
+// CacheTree is a node of the cache-tree ("TREE") extension, which records
+// the tree object built for a directory of the index. An entryCount of -1
+// marks a directory whose entries changed since the tree was written.
+type CacheTree struct {
+	name       string
+	entryCount int
+	sha        string
+	children   []*CacheTree
+}
+
+// Index is the staging area stored in .git/index.
+type Index struct {
+	version    uint32
+	entries    []*IndexEntry
+	cacheTree  *CacheTree
+	extensions []IndexExtension
+}
+
+func (e *IndexEntry) stage() int {
+	return int(e.flags&indexFlagStageMask) >> indexFlagStageShift
+}
+
+// modeString returns the mode of e as it is written in tree objects.
+func (e *IndexEntry) modeString() string {
+	return fmt.Sprintf("%o", e.mode)
+}
+
+func indexPath(repoPath string) string {
+	return path.Join(repoPath, ".git", "index")
+}
+
+// readIndex reads .git/index of repoPath. A missing index is returned as
+// an empty one.
+func readIndex(repoPath string) (*Index, error) {
+	data, err := os.ReadFile(indexPath(repoPath))
+	if os.IsNotExist(err) {
+		return &Index{version: 2}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12+sha1.Size || !bytes.Equal(data[:4], indexSignature) {
+		return nil, errors.New("index file corrupt: bad signature")
+	}
+	content, storedChecksum := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	if calculatedChecksum := sha1.Sum(content); !bytes.Equal(calculatedChecksum[:], storedChecksum) {
+		return nil, errors.New("index file corrupt: bad checksum")
+	}
+
+	idx := &Index{version: binary.BigEndian.Uint32(content[4:8])}
+	if idx.version != 2 && idx.version != 3 {
+		return nil, fmt.Errorf("unsupported index version: %d", idx.version)
+	}
+	count := int(binary.BigEndian.Uint32(content[8:12]))
+	offset := 12
+	for i := 0; i < count; i++ {
+		entry, n, err := parseIndexEntry(content[offset:], idx.version)
+		if err != nil {
+			return nil, fmt.Errorf("index file corrupt: %w", err)
+		}
+		idx.entries = append(idx.entries, entry)
+		offset += n
+	}
+
+	for offset < len(content) {
+		if len(content)-offset < 8 {
+			return nil, errors.New("index file corrupt: truncated extension")
+		}
+		signature := string(content[offset : offset+4])
+		size := int(binary.BigEndian.Uint32(content[offset+4 : offset+8]))
+		offset += 8
+		if len(content)-offset < size {
+			return nil, errors.New("index file corrupt: truncated extension")
+		}
+		// extensions starting with a lowercase letter change how the index
+		// must be read and cannot be ignored
+		if signature[0] < 'A' || signature[0] > 'Z' {
+			return nil, fmt.Errorf("unsupported index extension: %s", signature)
+		}
+		if signature == "TREE" {
+			// an unreadable cache tree is only a missed optimisation
+			idx.cacheTree, _, _ = parseCacheTree(content[offset : offset+size])
+			offset += size
+			continue
+		}
+		idx.extensions = append(idx.extensions, IndexExtension{
+			signature: signature,
+			data:      content[offset : offset+size],
+		})
+		offset += size
+	}
+	return idx, nil
+}
+
+// parseIndexEntry parses the entry at the start of data and returns it with
+// the number of bytes it occupies, including the NUL padding after the
+// name that aligns entries to eight bytes.
+func parseIndexEntry(data []byte, version uint32) (*IndexEntry, int, error) {
+	const fixedLen = 62
+	if len(data) < fixedLen {
+		return nil, 0, errors.New("truncated entry")
+	}
+	be := binary.BigEndian
+	entry := &IndexEntry{
+		ctimeSec:  be.Uint32(data[0:]),
+		ctimeNsec: be.Uint32(data[4:]),
+		mtimeSec:  be.Uint32(data[8:]),
+		mtimeNsec: be.Uint32(data[12:]),
+		dev:       be.Uint32(data[16:]),
+		ino:       be.Uint32(data[20:]),
+		mode:      be.Uint32(data[24:]),
+		uid:       be.Uint32(data[28:]),
+		gid:       be.Uint32(data[32:]),
+		size:      be.Uint32(data[36:]),
+		sha:       hex.EncodeToString(data[40:60]),
+		flags:     be.Uint16(data[60:]),
+	}
+	n := fixedLen
+	if entry.flags&indexFlagExtended != 0 {
+		if version < 3 || len(data) < n+2 {
+			return nil, 0, errors.New("unexpected extended flags")
+		}
+		entry.extendedFlags = be.Uint16(data[n:])
+		n += 2
+	}
+	nameLen := bytes.IndexByte(data[n:], 0)
+	if nameLen < 0 {
+		return nil, 0, errors.New("unterminated entry name")
+	}
+	entry.name = string(data[n : n+nameLen])
+	n += nameLen
+	n += 8 - n%8
+	if n > len(data) {
+		return nil, 0, errors.New("truncated entry")
+	}
+	return entry, n, nil
+}
+
+// sortEntries orders the entries by path and then by stage, which is the
+// order git requires in the index.
+func (idx *Index) sortEntries() {
+	sort.SliceStable(idx.entries, func(i, j int) bool {
+		if idx.entries[i].name != idx.entries[j].name {
+			return idx.entries[i].name < idx.entries[j].name
+		}
+		return idx.entries[i].stage() < idx.entries[j].stage()
+	})
+}
+
+// write stores the index in .git/index through a lock file, so that a
+// failed write never leaves a truncated index behind.
+func (idx *Index) write(repoPath string) error {
+	idx.sortEntries()
+	version := uint32(2)
+	for _, entry := range idx.entries {
+		if entry.flags&indexFlagExtended != 0 {
+			version = 3
+		}
+	}
+	if idx.version > version {
+		version = idx.version
+	}
+
+	var buf bytes.Buffer
+	buf.Write(indexSignature)
+	binary.Write(&buf, binary.BigEndian, version)
+	binary.Write(&buf, binary.BigEndian, uint32(len(idx.entries)))
+	for _, entry := range idx.entries {
+		start := buf.Len()
+		binary.Write(&buf, binary.BigEndian, []uint32{
+			entry.ctimeSec, entry.ctimeNsec, entry.mtimeSec, entry.mtimeNsec,
+			entry.dev, entry.ino, entry.mode, entry.uid, entry.gid, entry.size,
+		})
+		sha, err := hex.DecodeString(entry.sha)
+		if err != nil || len(sha) != sha1.Size {
+			return fmt.Errorf("invalid object id for %s: %s", entry.name, entry.sha)
+		}
+		buf.Write(sha)
+		nameLen := len(entry.name)
+		if nameLen > indexFlagNameMask {
+			nameLen = indexFlagNameMask
+		}
+		flags := entry.flags&^indexFlagNameMask | uint16(nameLen)
+		binary.Write(&buf, binary.BigEndian, flags)
+		if flags&indexFlagExtended != 0 {
+			binary.Write(&buf, binary.BigEndian, entry.extendedFlags)
+		}
+		buf.WriteString(entry.name)
+		padding := 8 - (buf.Len()-start)%8
+		buf.Write(make([]byte, padding))
+	}
+	if idx.cacheTree != nil {
+		var treeData bytes.Buffer
+		idx.cacheTree.serialize(&treeData)
+		buf.WriteString("TREE")
+		binary.Write(&buf, binary.BigEndian, uint32(treeData.Len()))
+		buf.Write(treeData.Bytes())
+	}
+	for _, ext := range idx.extensions {
+		buf.WriteString(ext.signature)
+		binary.Write(&buf, binary.BigEndian, uint32(len(ext.data)))
+		buf.Write(ext.data)
+	}
+	checksum := sha1.Sum(buf.Bytes())
+	buf.Write(checksum[:])
+
+	lockPath := indexPath(repoPath) + ".lock"
+	lockFile, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to lock index: %w", err)
+	}
+	if _, err := lockFile.Write(buf.Bytes()); err != nil {
+		lockFile.Close()
+		os.Remove(lockPath)
+		return err
+	}
+	if err := lockFile.Close(); err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	return os.Rename(lockPath, indexPath(repoPath))
+}
+
+// find returns the position of the stage 0 entry for name, or where it
+// would be inserted.
+func (idx *Index) find(name string) (int, bool) {
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].name >= name
+	})
+	return i, i < len(idx.entries) && idx.entries[i].name == name
+}
+
+// remove drops every entry, at any stage, for name.
+func (idx *Index) remove(name string) {
+	idx.invalidatePath(name)
+	entries := idx.entries[:0]
+	for _, entry := range idx.entries {
+		if entry.name != name {
+			entries = append(entries, entry)
+		}
+	}
+	idx.entries = entries
+}
+
+// add stages entry, replacing any entry for the same path, entries below
+// it when it used to be a directory and entries for its parent
+// directories when they used to be files.
+func (idx *Index) add(entry *IndexEntry) {
+	idx.invalidatePath(entry.name)
+	entries := idx.entries[:0]
+	for _, existing := range idx.entries {
+		if existing.name == entry.name ||
+			strings.HasPrefix(existing.name, entry.name+"/") ||
+			strings.HasPrefix(entry.name, existing.name+"/") {
+			if existing.name != entry.name {
+				idx.invalidatePath(existing.name)
+			}
+			continue
+		}
+		entries = append(entries, existing)
+	}
+	idx.entries = entries
+	i, _ := idx.find(entry.name)
+	idx.entries = append(idx.entries, nil)
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = entry
+}
+
+// invalidateExtensions drops the optional extensions other than the cache
+// tree, which describe the entries as they were when the index was read.
+// The cache tree is kept up to date by invalidatePath instead.
+func (idx *Index) invalidateExtensions() {
+	idx.extensions = nil
+}
+
+func parseCacheTree(data []byte) (*CacheTree, []byte, error) {
+	nameLen := bytes.IndexByte(data, 0)
+	if nameLen < 0 {
+		return nil, nil, errors.New("invalid cache tree")
+	}
+	node := &CacheTree{name: string(data[:nameLen])}
+	data = data[nameLen+1:]
+	line, rest, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil, nil, errors.New("invalid cache tree")
+	}
+	var subtreeCount int
+	if _, err := fmt.Sscanf(string(line), "%d %d", &node.entryCount, &subtreeCount); err != nil {
+		return nil, nil, fmt.Errorf("invalid cache tree: %w", err)
+	}
+	data = rest
+	if node.entryCount >= 0 {
+		if len(data) < sha1.Size {
+			return nil, nil, errors.New("invalid cache tree")
+		}
+		node.sha = hex.EncodeToString(data[:sha1.Size])
+		data = data[sha1.Size:]
+	}
+	for i := 0; i < subtreeCount; i++ {
+		child, rest, err := parseCacheTree(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		node.children = append(node.children, child)
+		data = rest
+	}
+	return node, data, nil
+}
+
+func (t *CacheTree) serialize(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "%s\x00%d %d\n", t.name, t.entryCount, len(t.children))
+	if t.entryCount >= 0 {
+		sha, _ := hex.DecodeString(t.sha)
+		buf.Write(sha)
+	}
+	for _, child := range t.children {
+		child.serialize(buf)
+	}
+}
+
+func (t *CacheTree) child(name string) *CacheTree {
+	if t == nil {
+		return nil
+	}
+	for _, child := range t.children {
+		if child.name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// invalidatePath marks the cache tree nodes of every directory containing
+// name as stale.
+func (idx *Index) invalidatePath(name string) {
+	node := idx.cacheTree
+	components := strings.Split(name, "/")
+	for i := 0; node != nil; i++ {
+		node.entryCount = -1
+		if i == len(components)-1 {
+			break
+		}
+		node = node.child(components[i])
+	}
+}
+
+// buildTree writes the tree for entries, which are the sorted index
+// entries below prefix, and returns its cache tree node. A cached node that
+// is still valid for the same number of entries is reused as is.
+func buildTree(entries []*IndexEntry, prefix string, cached *CacheTree) (*CacheTree, error) {
+	if cached != nil && cached.entryCount == len(entries) && cached.sha != "" {
+		if objReader, err := NewGitObjectReader(".", cached.sha); err == nil {
+			objReader.Close()
+			return cached, nil
+		}
+	}
+	node := &CacheTree{entryCount: len(entries)}
+	children := []TreeChild{}
+	for i := 0; i < len(entries); {
+		rel := entries[i].name[len(prefix):]
+		slash := strings.IndexByte(rel, '/')
+		if slash < 0 {
+			children = append(children, TreeChild{mode: entries[i].modeString(), name: rel, sha: entries[i].sha})
+			i++
+			continue
+		}
+		dir := rel[:slash]
+		j := i
+		for j < len(entries) && strings.HasPrefix(entries[j].name, prefix+dir+"/") {
+			j++
+		}
+		subtree, err := buildTree(entries[i:j], prefix+dir+"/", cached.child(dir))
+		if err != nil {
+			return nil, err
+		}
+		subtree.name = dir
+		node.children = append(node.children, subtree)
+		children = append(children, TreeChild{mode: "40000", name: dir, sha: subtree.sha})
+		i = j
+	}
+	_, node.sha = writeObject("tree", serializeTree(children))
+	return node, nil
+}
+
+// writeTree writes the trees for the staged entries of the index and
+// returns the id of the root tree. Intent-to-add entries are left out.
+func (idx *Index) writeTree() (string, error) {
+	entries := []*IndexEntry{}
+	for _, entry := range idx.entries {
+		if entry.stage() != 0 {
+			return "", fmt.Errorf("%s: unmerged entry", entry.name)
+		}
+		if entry.extendedFlags&indexFlagIntentToAdd != 0 {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	root, err := buildTree(entries, "", idx.cacheTree)
+	if err != nil {
+		return "", err
+	}
+	idx.cacheTree = root
+	return root.sha, nil
+}
+
+// newIndexEntry hashes the working tree file at name and returns an index
+// entry for it with the file's stat data. The blob is only stored when
+// write is set.
+func newIndexEntry(repoPath, name string, write bool) (*IndexEntry, error) {
+	filePath := filepath.Join(repoPath, filepath.FromSlash(name))
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	entry := &IndexEntry{name: name}
+	fillStatData(entry, info)
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return nil, err
+		}
+		entry.mode = indexModeSymlink
+		entry.sha, err = hashStream("blob", int64(len(target)), strings.NewReader(target), write)
+		if err != nil {
+			return nil, err
+		}
+	case info.IsDir():
+		commitSha, err := readRef(filePath, "HEAD")
+		if err != nil {
+			return nil, fmt.Errorf("'%s' does not have a commit checked out", name)
+		}
+		entry.mode = indexModeGitlink
+		entry.sha = commitSha
+	default:
+		entry.mode = indexModeRegular
+		if info.Mode()&0100 != 0 {
+			entry.mode = indexModeExecutable
+		}
+		entry.sha, err = hashInput("blob", filePath, nil, write)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+// normalizePathspec turns a command line path into a path relative to the
+// repository root using forward slashes; "" stands for the whole tree.
+func normalizePathspec(pathspec string) (string, error) {
+	cleaned := filepath.ToSlash(filepath.Clean(pathspec))
+	if cleaned == "." {
+		return "", nil
+	}
+	if strings.HasPrefix(cleaned, "../") || cleaned == ".." || path.IsAbs(cleaned) {
+		return "", fmt.Errorf("'%s' is outside repository", pathspec)
+	}
+	return cleaned, nil
+}
+
+// matchesPathspec reports whether name is pathspec or lies below it.
+func matchesPathspec(name, pathspec string) bool {
+	return pathspec == "" || name == pathspec || strings.HasPrefix(name, pathspec+"/")
+}
+
+// collectWorktreeFiles returns the files, symlinks and nested repositories
+// at or below pathspec in the working tree, leaving out the paths for
+// which ignored returns true.
+func collectWorktreeFiles(repoPath, pathspec string, ignored func(name string, isDir bool) bool) ([]string, error) {
+	files := []string{}
+	root := filepath.Join(repoPath, filepath.FromSlash(pathspec))
+	err := filepath.WalkDir(root, func(walkPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(repoPath, walkPath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if d.Name() == ".git" && walkPath != root {
+			return filepath.SkipDir
+		}
+		if walkPath != root && ignored(name, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			files = append(files, name)
+			return nil
+		}
+		if name != "." && walkPath != root {
+			if _, err := os.Stat(filepath.Join(walkPath, ".git")); err == nil {
+				files = append(files, name)
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+func addFiles(args []string) int {
+	force := false
+	pathspecs := []string{}
+	for _, arg := range args {
+		switch arg {
+		case "-f", "--force":
+			force = true
+		case "--":
+		default:
+			pathspecs = append(pathspecs, arg)
+		}
+	}
+	if len(pathspecs) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: mygit add [-f] <pathspec>...\n")
+		return 1
+	}
+	idx, err := readIndex(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading index: %s\n", err)
+		return 1
+	}
+	matcher, err := newIgnoreMatcher(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading ignore files: %s\n", err)
+		return 1
+	}
+	trackedDirs := make(map[string]bool)
+	for _, entry := range idx.entries {
+		for dir := path.Dir(entry.name); dir != "."; dir = path.Dir(dir) {
+			trackedDirs[dir] = true
+		}
+	}
+	// tracked paths are updated even when they match an ignore pattern
+	ignored := func(name string, isDir bool) bool {
+		if force || trackedDirs[name] {
+			return false
+		}
+		if _, tracked := idx.find(name); tracked {
+			return false
+		}
+		return matcher.isIgnored(name, isDir)
+	}
+
+	ignoredArgs := []string{}
+	for _, arg := range pathspecs {
+		pathspec, err := normalizePathspec(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+
+		files := []string{}
+		if info, err := os.Lstat(filepath.FromSlash(arg)); err == nil {
+			if pathspec != "" && ignored(pathspec, info.IsDir()) {
+				ignoredArgs = append(ignoredArgs, pathspec)
+				continue
+			}
+			if files, err = collectWorktreeFiles(".", pathspec, ignored); err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", arg, err)
+				return 1
+			}
+		}
+		// tracked files that are gone from the working tree are unstaged
+		removed := []string{}
+		for _, entry := range idx.entries {
+			if !matchesPathspec(entry.name, pathspec) {
+				continue
+			}
+			if _, err := os.Lstat(filepath.FromSlash(entry.name)); os.IsNotExist(err) {
+				removed = append(removed, entry.name)
+			}
+		}
+		if len(files) == 0 && len(removed) == 0 {
+			fmt.Fprintf(os.Stderr, "fatal: pathspec '%s' did not match any files\n", arg)
+			return 1
+		}
+
+		for _, name := range removed {
+			idx.remove(name)
+		}
+		for _, name := range files {
+			if i, ok := idx.find(name); ok && idx.entries[i].stage() == 0 && !entryChanged(idx.entries[i], name) {
+				continue
+			}
+			entry, err := newIndexEntry(".", name, true)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error adding %s: %s\n", name, err)
+				return 1
+			}
+			idx.add(entry)
+		}
+	}
+	idx.invalidateExtensions()
+	if err := idx.write("."); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing index: %s\n", err)
+		return 1
+	}
+	if len(ignoredArgs) > 0 {
+		fmt.Fprintf(os.Stderr, "The following paths are ignored by one of your .gitignore files:\n")
+		for _, name := range ignoredArgs {
+			fmt.Fprintln(os.Stderr, name)
+		}
+		fmt.Fprintf(os.Stderr, "hint: Use -f if you really want to add them.\n")
+		return 1
+	}
+	return 0
+}
+
+// entryChanged reports whether the working tree file for entry differs
+// from the stat data recorded in the index, without hashing it.
+func entryChanged(entry *IndexEntry, name string) bool {
+	info, err := os.Lstat(filepath.FromSlash(name))
+	if err != nil {
+		return true
+	}
+	current := &IndexEntry{}
+	fillStatData(current, info)
+	return current.mtimeSec != entry.mtimeSec || current.mtimeNsec != entry.mtimeNsec ||
+		current.ctimeSec != entry.ctimeSec || current.ctimeNsec != entry.ctimeNsec ||
+		current.ino != entry.ino || current.size != entry.size ||
+		current.uid != entry.uid || current.gid != entry.gid
+}
+
+func lsFiles(args []string) int {
+	showStage := false
+	pathspecs := []string{}
+	for _, arg := range args {
+		switch {
+		case arg == "-s" || arg == "--stage":
+			showStage = true
+		case arg == "-c" || arg == "--cached" || arg == "--":
+		case strings.HasPrefix(arg, "-"):
+			fmt.Fprintf(os.Stderr, "Unknown option %s\n", arg)
+			return 1
+		default:
+			pathspec, err := normalizePathspec(arg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				return 1
+			}
+			pathspecs = append(pathspecs, pathspec)
+		}
+	}
+	idx, err := readIndex(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading index: %s\n", err)
+		return 1
+	}
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+	for _, entry := range idx.entries {
+		matched := len(pathspecs) == 0
+		for _, pathspec := range pathspecs {
+			matched = matched || matchesPathspec(entry.name, pathspec)
+		}
+		if !matched {
+			continue
+		}
+		if showStage {
+			fmt.Fprintf(writer, "%06o %s %d\t%s\n", entry.mode, entry.sha, entry.stage(), entry.name)
+		} else {
+			fmt.Fprintln(writer, entry.name)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fillStatData records the stat data of info in entry, truncated to 32
+// bits like git does.
+func fillStatData(entry *IndexEntry, info os.FileInfo) {
+	entry.mtimeSec = uint32(info.ModTime().Unix())
+	entry.mtimeNsec = uint32(info.ModTime().Nanosecond())
+	entry.size = uint32(info.Size())
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	entry.ctimeSec = uint32(stat.Ctim.Sec)
+	entry.ctimeNsec = uint32(stat.Ctim.Nsec)
+	entry.dev = uint32(stat.Dev)
+	entry.ino = uint32(stat.Ino)
+	entry.uid = stat.Uid
+	entry.gid = stat.Gid
+}
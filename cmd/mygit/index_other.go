@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// fillStatData records the stat data of info in entry. Only the portable
+// fields are available outside Linux.
+func fillStatData(entry *IndexEntry, info os.FileInfo) {
+	entry.mtimeSec = uint32(info.ModTime().Unix())
+	entry.mtimeNsec = uint32(info.ModTime().Nanosecond())
+	entry.ctimeSec = entry.mtimeSec
+	entry.ctimeNsec = entry.mtimeNsec
+	entry.size = uint32(info.Size())
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// checkIndexRoundTrip reads the index git wrote in repo, writes it back and
+// checks that the file is unchanged.
+func checkIndexRoundTrip(t *testing.T, repo string) {
+	t.Helper()
+	want, err := os.ReadFile(indexPath(repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := readIndex(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.write(repo); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(indexPath(repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("index written back differs from the one written by git")
+	}
+}
+
+// newIndexTestRepo returns a repository with a few committed files of each
+// kind git stages: regular, executable, symbolic link and nested.
+func newIndexTestRepo(t *testing.T) string {
+	t.Helper()
+	repo := t.TempDir()
+	runGit(t, repo, "init", "-q", "-b", "main")
+	if err := os.MkdirAll(filepath.Join(repo, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.txt":          "a\n",
+		"dir/b.txt":      "b\n",
+		"dir/sub/c.txt":  "c\n",
+		"dir-after.txt":  "sorts after dir/\n",
+		"conflicted.txt": "base\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(repo, "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(repo, "link")); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	return repo
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	requireGit(t)
+	setGitEnv(t)
+
+	t.Run("cache tree", func(t *testing.T) {
+		repo := newIndexTestRepo(t)
+		// committing leaves a cache tree that is valid throughout, and a
+		// file staged after that invalidates dir/sub and its parents
+		commitFile(t, repo, "dir/sub/d.txt", "d\n")
+		checkIndexRoundTrip(t, repo)
+		if err := os.WriteFile(filepath.Join(repo, "dir", "sub", "e.txt"), []byte("e\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, repo, "add", "dir/sub/e.txt")
+		checkIndexRoundTrip(t, repo)
+		idx, err := readIndex(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx.cacheTree == nil || idx.cacheTree.entryCount != -1 {
+			t.Errorf("cache tree was not read or not invalidated: %+v", idx.cacheTree)
+		}
+	})
+
+	t.Run("intent to add", func(t *testing.T) {
+		repo := newIndexTestRepo(t)
+		if err := os.WriteFile(filepath.Join(repo, "new.txt"), []byte("new\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, repo, "add", "-N", "new.txt")
+		checkIndexRoundTrip(t, repo)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		repo := newIndexTestRepo(t)
+		runGit(t, repo, "checkout", "-q", "-b", "topic")
+		commitFile(t, repo, "conflicted.txt", "topic\n")
+		runGit(t, repo, "checkout", "-q", "main")
+		commitFile(t, repo, "conflicted.txt", "main\n")
+		merge := exec.Command("git", "merge", "-q", "topic")
+		merge.Dir = repo
+		if merge.Run() == nil {
+			t.Fatal("merge did not conflict")
+		}
+		checkIndexRoundTrip(t, repo)
+
+		// resolving the conflict records the stages in a REUC extension,
+		// which is kept as raw data
+		runGit(t, repo, "add", "conflicted.txt")
+		checkIndexRoundTrip(t, repo)
+	})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+const (
+	packIdxVersion = 2
+	// offsets at or above this limit go to the 64-bit offset table
+	packIdxLargeOffset = 0x80000000
+)
+
+var packIdxMagic = []byte{0xff, 't', 'O', 'c'}
+
+// objectTypeCodes are the pack entry types of the object types.
+var objectTypeCodes = map[string]byte{
+	"commit": objCommit,
+	"tree":   objTree,
+	"blob":   objBlob,
+	"tag":    objTag,
+}
+
+// writePackIndex writes a version 2 pack index for the resolved entries of
+// p to idxPath.
+func writePackIndex(p *Packfile, idxPath string) error {
+	entries := make([]*PackEntry, len(p.entries))
+	copy(entries, p.entries)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].sha < entries[j].sha
+	})
+
+	idxFile, err := os.CreateTemp(path.Dir(idxPath), "tmp_idx_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(idxFile.Name())
+	defer idxFile.Close()
+
+	idxHash := sha1.New()
+	w := bufio.NewWriter(io.MultiWriter(idxFile, idxHash))
+	write := func(data any) {
+		if err == nil {
+			err = binary.Write(w, binary.BigEndian, data)
+		}
+	}
+
+	write(packIdxMagic)
+	write(uint32(packIdxVersion))
+
+	fanout := [256]uint32{}
+	for _, entry := range entries {
+		b, decodeErr := hex.DecodeString(entry.sha[:2])
+		if decodeErr != nil {
+			return decodeErr
+		}
+		fanout[b[0]]++
+	}
+	for i := 1; i < len(fanout); i++ {
+		fanout[i] += fanout[i-1]
+	}
+	write(fanout)
+
+	for _, entry := range entries {
+		name, decodeErr := hex.DecodeString(entry.sha)
+		if decodeErr != nil {
+			return decodeErr
+		}
+		write(name)
+	}
+	for _, entry := range entries {
+		write(entry.crc)
+	}
+	largeOffsets := []uint64{}
+	for _, entry := range entries {
+		if entry.offset < packIdxLargeOffset {
+			write(uint32(entry.offset))
+			continue
+		}
+		write(uint32(packIdxLargeOffset | len(largeOffsets)))
+		largeOffsets = append(largeOffsets, uint64(entry.offset))
+	}
+	write(largeOffsets)
+	write(p.checksum)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := idxFile.Write(idxHash.Sum(nil)); err != nil {
+		return err
+	}
+	if err := idxFile.Chmod(0444); err != nil {
+		return err
+	}
+	if err := idxFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(idxFile.Name(), idxPath)
+}
+
+// writePackEntryHeader writes the type and size of a pack entry: the type
+// and the low four bits of the size in the first byte, then the rest of
+// the size seven bits at a time.
+func writePackEntryHeader(w io.Writer, objType byte, size int) error {
+	header := []byte{}
+	b := objType<<4 | byte(size)&firstRemMask
+	size >>= 4
+	for size > 0 {
+		header = append(header, b|msbMask)
+		b = byte(size) & remMask
+		size >>= 7
+	}
+	header = append(header, b)
+	_, err := w.Write(header)
+	return err
+}
+
+// appendObject stores obj whole at the end of the pack, in place of the
+// trailing checksum, and records it as a new entry. This completes a thin
+// pack, whose deltas may use bases the repository already has.
+func (p *Packfile) appendObject(obj *Object) (*PackEntry, error) {
+	f, err := os.OpenFile(p.file.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	if err := writePackEntryHeader(&buf, obj.Type, len(obj.Buf)); err != nil {
+		return nil, err
+	}
+	entry := &PackEntry{
+		offset:     p.dataEnd,
+		dataOffset: p.dataEnd + int64(buf.Len()),
+		objType:    obj.Type,
+		size:       len(obj.Buf),
+	}
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(obj.Buf); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	entry.crc = crc32.ChecksumIEEE(buf.Bytes())
+	if _, err := f.WriteAt(buf.Bytes(), p.dataEnd); err != nil {
+		return nil, err
+	}
+	p.dataEnd += int64(buf.Len())
+	p.entries = append(p.entries, entry)
+	return entry, f.Close()
+}
+
+// finishThinPack updates the object count in the header of a pack that had
+// objects appended and writes its new checksum after them.
+func (p *Packfile) finishThinPack() error {
+	f, err := os.OpenFile(p.file.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p.objectCount = len(p.entries)
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(p.objectCount))
+	if _, err := f.WriteAt(count, 8); err != nil {
+		return err
+	}
+	packHash := sha1.New()
+	if _, err := io.Copy(packHash, io.NewSectionReader(f, 0, p.dataEnd)); err != nil {
+		return err
+	}
+	p.checksum = packHash.Sum(nil)
+	if _, err := f.WriteAt(p.checksum, p.dataEnd); err != nil {
+		return err
+	}
+	if err := f.Truncate(p.dataEnd + int64(len(p.checksum))); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// indexPack verifies the pack at tmpPackPath, completes it when it is thin,
+// moves it to .git/objects/pack/pack-<checksum>.pack and writes the
+// matching .idx. visit is passed on to resolveEntries and may be nil.
+func indexPack(repoPath, tmpPackPath string, visit func(obj *Object) error) (string, error) {
+	packfile, err := openPackfile(tmpPackPath)
+	if err != nil {
+		return "", err
+	}
+	defer packfile.Close()
+	if err := packfile.indexEntries(); err != nil {
+		return "", err
+	}
+	thinBase := func(sha string) (*Object, error) {
+		if !hasObject(repoPath, sha) {
+			return nil, fmt.Errorf("unknown obj sha: %s", sha)
+		}
+		objReader, err := NewGitObjectReader(repoPath, sha)
+		if err != nil {
+			return nil, err
+		}
+		defer objReader.Close()
+		contents, err := objReader.ReadContents()
+		if err != nil {
+			return nil, err
+		}
+		return &Object{Type: objectTypeCodes[objReader.Type], Buf: contents}, nil
+	}
+	if err := packfile.resolveEntries(visit, thinBase); err != nil {
+		return "", err
+	}
+	if len(packfile.entries) > packfile.objectCount {
+		if err := packfile.finishThinPack(); err != nil {
+			return "", err
+		}
+	}
+
+	packDir := path.Join(repoPath, ".git", "objects", "pack")
+	packName := fmt.Sprintf("pack-%x", packfile.checksum)
+	packPath := path.Join(packDir, packName+".pack")
+	if err := os.Chmod(tmpPackPath, 0444); err != nil {
+		return "", err
+	}
+	_, statErr := os.Stat(packPath)
+	existed := statErr == nil
+	if err := os.Rename(tmpPackPath, packPath); err != nil {
+		return "", err
+	}
+	if err := writePackIndex(packfile, path.Join(packDir, packName+".idx")); err != nil {
+		// a pack without its .idx is never looked at again, but one that
+		// was there before may still have its old .idx
+		if !existed {
+			os.Remove(packPath)
+		}
+		return "", err
+	}
+	// the packs opened so far do not include the new one
+	for _, p := range openedPacks[repoPath] {
+		p.Close()
+	}
+	delete(openedPacks, repoPath)
+	return packPath, nil
+}
+
+// PackIndex is a version 2 pack index loaded in memory.
+type PackIndex struct {
+	fanout       [256]uint32
+	names        []byte
+	offsets      []uint32
+	largeOffsets []uint64
+}
+
+func readPackIndex(idxPath string) (*PackIndex, error) {
+	f, err := os.Open(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], packIdxMagic) {
+		return nil, fmt.Errorf("%s: unsupported pack index format", idxPath)
+	}
+	if version := binary.BigEndian.Uint32(header[4:]); version != packIdxVersion {
+		return nil, fmt.Errorf("%s: unsupported pack index version: %d", idxPath, version)
+	}
+
+	idx := &PackIndex{}
+	if err := binary.Read(reader, binary.BigEndian, &idx.fanout); err != nil {
+		return nil, err
+	}
+	count := int(idx.fanout[255])
+	idx.names = make([]byte, count*sha1.Size)
+	if _, err := io.ReadFull(reader, idx.names); err != nil {
+		return nil, err
+	}
+	if _, err := reader.Discard(count * 4); err != nil { // CRC32s
+		return nil, err
+	}
+	idx.offsets = make([]uint32, count)
+	if err := binary.Read(reader, binary.BigEndian, idx.offsets); err != nil {
+		return nil, err
+	}
+	largeCount := 0
+	for _, offset := range idx.offsets {
+		if offset&packIdxLargeOffset != 0 {
+			largeCount++
+		}
+	}
+	idx.largeOffsets = make([]uint64, largeCount)
+	if err := binary.Read(reader, binary.BigEndian, idx.largeOffsets); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// findOffset returns the pack offset of the object named sha.
+func (idx *PackIndex) findOffset(sha string) (int64, bool) {
+	name, err := hex.DecodeString(sha)
+	if err != nil || len(name) != sha1.Size {
+		return 0, false
+	}
+	lo := 0
+	if name[0] > 0 {
+		lo = int(idx.fanout[name[0]-1])
+	}
+	hi := int(idx.fanout[name[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.names[(lo+i)*sha1.Size:(lo+i+1)*sha1.Size], name) >= 0
+	})
+	if i >= hi || !bytes.Equal(idx.names[i*sha1.Size:(i+1)*sha1.Size], name) {
+		return 0, false
+	}
+	offset := idx.offsets[i]
+	if offset&packIdxLargeOffset == 0 {
+		return int64(offset), true
+	}
+	return int64(idx.largeOffsets[offset&^packIdxLargeOffset]), true
+}
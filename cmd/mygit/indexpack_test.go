@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// runGitInput runs the git command line in dir with input on its standard
+// input and returns its standard output.
+func runGitInput(t *testing.T, dir, input string, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, stderr.Bytes())
+	}
+	return out
+}
+
+// commitFile writes contents to name in the repository at dir, commits it
+// and returns the id of the commit.
+func commitFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", name)
+	runGit(t, dir, "commit", "-q", "-m", name)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+// numberedLines returns n lines that differ enough from each other for
+// git to store later versions of a file as deltas.
+func numberedLines(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "line %d of a file that changes a little in every commit\n", i)
+	}
+	return b.String()
+}
+
+// indexTestPack runs indexPack on a copy of pack in the repository at
+// repoPath and returns the path of the stored pack.
+func indexTestPack(t *testing.T, repoPath string, pack []byte) string {
+	t.Helper()
+	tmpPackPath := filepath.Join(repoPath, ".git", "objects", "pack", "tmp_pack_test")
+	if err := os.WriteFile(tmpPackPath, pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+	packPath, err := indexPack(repoPath, tmpPackPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packPath
+}
+
+func TestIndexPackMatchesGit(t *testing.T) {
+	requireGit(t)
+	setGitEnv(t)
+
+	src := t.TempDir()
+	runGit(t, src, "init", "-q")
+	contents := numberedLines(200)
+	for i := 0; i < 4; i++ {
+		contents += fmt.Sprintf("change %d\n", i)
+		commitFile(t, src, "file.txt", contents)
+	}
+	base := strings.Repeat("line of the base blob\n", 20)
+	b := newPackBuilder()
+	b.refDelta(t, blobSha(t, base+"first\n"), appendDelta([]byte(base+"first\n"), []byte("second\n")))
+	baseOffset := b.whole(t, objBlob, []byte(base))
+	b.ofsDelta(t, baseOffset, appendDelta([]byte(base), []byte("first\n")))
+
+	packs := map[string][]byte{
+		"ofs deltas": runGitInput(t, src, "", "pack-objects", "-q", "--revs", "--all", "--delta-base-offset", "--stdout"),
+		"ref deltas": runGitInput(t, src, "", "pack-objects", "-q", "--revs", "--all", "--stdout"),
+		// a REF_DELTA whose base is an OFS_DELTA later in the pack
+		"out of order": b.pack(),
+	}
+	for name, pack := range packs {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			gitPackPath := filepath.Join(dir, "git.pack")
+			if err := os.WriteFile(gitPackPath, pack, 0644); err != nil {
+				t.Fatal(err)
+			}
+			runGit(t, dir, "index-pack", "-o", "git.idx", gitPackPath)
+			wantIdx, err := os.ReadFile(filepath.Join(dir, "git.idx"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			repo := filepath.Join(dir, "repo")
+			runGit(t, dir, "init", "-q", repo)
+			packPath := indexTestPack(t, repo, pack)
+			if want := fmt.Sprintf("pack-%x.pack", pack[len(pack)-sha1.Size:]); filepath.Base(packPath) != want {
+				t.Errorf("pack stored as %s, want %s", filepath.Base(packPath), want)
+			}
+			gotIdx, err := os.ReadFile(strings.TrimSuffix(packPath, ".pack") + ".idx")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(gotIdx, wantIdx) {
+				t.Errorf("index differs from the one written by git index-pack")
+			}
+		})
+	}
+}
+
+func TestIndexPackThinPack(t *testing.T) {
+	requireGit(t)
+	setGitEnv(t)
+
+	src := t.TempDir()
+	runGit(t, src, "init", "-q")
+	contents := numberedLines(200)
+	first := commitFile(t, src, "file.txt", contents)
+	contents += "one more line\n"
+	second := commitFile(t, src, "file.txt", contents)
+
+	// the repository only has the objects of the first commit, which hold
+	// the delta bases of the thin pack
+	dest := t.TempDir()
+	runGit(t, dest, "init", "-q")
+	runGit(t, dest, "fetch", "-q", src, first+":refs/heads/first")
+
+	pack := runGitInput(t, src, second+"\n^"+first+"\n", "pack-objects", "-q", "--revs", "--thin", "--stdout")
+	thinCount := binary.BigEndian.Uint32(pack[8:12])
+	packPath := indexTestPack(t, dest, pack)
+
+	stored, err := os.ReadFile(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := binary.BigEndian.Uint32(stored[8:12]); count <= thinCount {
+		t.Errorf("completed pack has %d objects, the thin pack had %d", count, thinCount)
+	}
+	runGit(t, dest, "verify-pack", strings.TrimSuffix(packPath, ".pack")+".idx")
+	runGit(t, dest, "update-ref", "refs/heads/second", second)
+	runGit(t, dest, "fsck", "--strict")
+	if got := runGit(t, dest, "cat-file", "-p", second+":file.txt"); got != strings.TrimSpace(contents) {
+		t.Errorf("file.txt in the second commit is %q", got)
+	}
+}
+
+func TestPackIndexLargeOffsets(t *testing.T) {
+	requireGit(t)
+
+	offsets := []int64{12, packIdxLargeOffset - 1, packIdxLargeOffset, 5<<32 + 7}
+	p := &Packfile{checksum: make([]byte, sha1.Size)}
+	for i, offset := range offsets {
+		p.entries = append(p.entries, &PackEntry{
+			offset: offset,
+			sha:    fmt.Sprintf("%x", sha1.Sum([]byte{byte(i)})),
+			crc:    uint32(i),
+		})
+	}
+	dir := t.TempDir()
+	idxPath := filepath.Join(dir, "test.idx")
+	if err := writePackIndex(p, idxPath); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := readPackIndex(idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range p.entries {
+		if offset, ok := idx.findOffset(entry.sha); !ok || offset != entry.offset {
+			t.Errorf("findOffset(%s) = %d, %t, want %d", entry.sha, offset, ok, entry.offset)
+		}
+	}
+	if _, ok := idx.findOffset(fmt.Sprintf("%x", sha1.Sum([]byte("missing")))); ok {
+		t.Errorf("findOffset found an object that is not in the index")
+	}
+
+	// git show-index prints "<offset> <sha> (<crc>)" for every entry
+	idxContents, err := os.ReadFile(idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shown := strings.Split(strings.TrimSpace(string(runGitInput(t, dir, string(idxContents), "show-index"))), "\n")
+	if len(shown) != len(offsets) {
+		t.Fatalf("git show-index listed %d entries, want %d", len(shown), len(offsets))
+	}
+	for _, line := range shown {
+		fields := strings.Fields(line)
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := idx.findOffset(fields[1]); offset != want {
+			t.Errorf("git show-index has %s at %d, want %d", fields[1], offset, want)
+		}
+	}
+}
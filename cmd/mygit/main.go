@@ -5,12 +5,10 @@ import (
 	"bytes"
 	"compress/zlib"
 	"crypto/sha1"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path"
 	"path/filepath"
@@ -19,12 +17,6 @@ import (
 	"strings"
 )
 
-type TreeEntry struct {
-	mode string
-	name string
-	sha  string
-}
-
 type Object struct {
 	Type byte
 	Buf  []byte
@@ -32,9 +24,11 @@ type Object struct {
 
 type GitObjectReader struct {
 	objectFileReader *bufio.Reader
-	ContentSize      int64
-	Type             string
-	Sha              string
+	// closer releases the loose object file; it is nil for packed objects
+	closer      io.Closer
+	ContentSize int64
+	Type        string
+	Sha         string
 }
 
 type TreeChild struct {
@@ -56,614 +50,733 @@ const (
 	objCommit = 1
 	objTree   = 2
 	objBlob   = 3
+	objTag    = 4
 
 	objOfsDelta = 6
 	objRefDelta = 7
 )
 
-var (
-	shaToObj map[string]Object = make(map[string]Object)
-)
-
-func nextTreeEntry(br *bufio.Reader) (TreeEntry, error) {
-	modeBytes, err := br.ReadBytes(' ')
-	if err != nil {
-		return TreeEntry{}, err
-	}
-	mode := string(modeBytes[:len(modeBytes)-1])
-	nameBytes, err := br.ReadBytes('\x00')
-	if err != nil {
-		return TreeEntry{}, err
-	}
-	name := string(nameBytes[:len(nameBytes)-1])
-
-	shaBytes := [20]byte{}
-	_, err = br.Read(shaBytes[:])
-	if err != nil {
-		return TreeEntry{}, err
+// hashStream computes the id of an object of objType whose size bytes of
+// contents are read from reader. When write is set the object is also
+// stored as a loose object, going through a temporary file so that large
+// blobs are never held in memory.
+func hashStream(objType string, size int64, reader io.Reader, write bool) (string, error) {
+	headerReader := strings.NewReader(fmt.Sprintf("%s %d\x00", objType, size))
+	reader = io.MultiReader(headerReader, io.LimitReader(reader, size))
+	hashWriter := sha1.New()
+	if !write {
+		n, err := io.Copy(hashWriter, reader)
+		if err != nil {
+			return "", err
+		}
+		if n != size+int64(headerReader.Size()) {
+			return "", fmt.Errorf("short read: expected %d bytes", size)
+		}
+		return fmt.Sprintf("%x", hashWriter.Sum(nil)), nil
 	}
-	sha := fmt.Sprintf("%x", shaBytes)
-	return TreeEntry{
-		mode: mode,
-		name: name,
-		sha:  sha,
-	}, nil
-}
 
-func hashObject(filename string) int {
-	s, err := os.Stat(filename)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting file info: %s\n", err)
-		os.Exit(1)
-	}
-	fileLength := s.Size()
-	// Reader 1 - header
-	headerReader := strings.NewReader(fmt.Sprintf("blob %d\x00", fileLength))
-	// Reader 2 - file content
-	fileReader, err := os.Open(filename)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening file: %s\n", err)
-		os.Exit(1)
+	if err := os.MkdirAll(".git/objects", 0755); err != nil {
+		return "", err
 	}
-	defer fileReader.Close()
-
-	reader := io.MultiReader(headerReader, fileReader)
-	// Writer 1 - hash
-	hashWriter := sha1.New()
-	// Writer 2 - zlib
-	fileWriter, err := os.CreateTemp("", "mygit.*.blob")
+	fileWriter, err := os.CreateTemp(".git/objects", "tmp_obj_")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating temp file: %s\n", err)
-		os.Exit(1)
+		return "", err
 	}
+	tempFilepath := fileWriter.Name()
+	defer os.Remove(tempFilepath)
 	defer fileWriter.Close()
 	zWriter := zlib.NewWriter(fileWriter)
-	defer zWriter.Close()
-
-	writer := io.MultiWriter(hashWriter, zWriter)
-
-	if _, err := io.Copy(writer, reader); err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing file: %s\n", err)
-		os.Exit(1)
+	if _, err := io.Copy(io.MultiWriter(hashWriter, zWriter), reader); err != nil {
+		return "", err
+	}
+	if err := zWriter.Close(); err != nil {
+		return "", err
+	}
+	if err := fileWriter.Close(); err != nil {
+		return "", err
 	}
+
 	sha := fmt.Sprintf("%x", hashWriter.Sum(nil))
 	prefix, filename := sha[:2], sha[2:]
 	if err := os.MkdirAll(path.Join(".git/objects", prefix), 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating directory: %s\n", err)
-		os.Exit(1)
+		return "", err
 	}
-
-	dstFilepath := path.Join(".git/objects", prefix, filename)
-	tempFilepath := fileWriter.Name()
-
-	if err := os.Rename(tempFilepath, dstFilepath); err != nil {
-		fmt.Fprintf(os.Stderr, "Error renaming file: %s\n", err)
-		err = os.Remove(dstFilepath)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error removing temp file: %s\n", err)
-			os.Exit(1)
-		}
-		os.Exit(1)
+	if err := os.Rename(tempFilepath, path.Join(".git/objects", prefix, filename)); err != nil {
+		return "", err
 	}
-	fmt.Println(sha)
-	return 0
+	return sha, nil
 }
 
-func lsTree(sha string) int {
-	const dir = ".git/objects"
-	prefix, filename := sha[:2], sha[2:]
-	filepath := path.Join(dir, prefix, filename)
-	f, err := os.Open(filepath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening file: %s\n", err)
-		os.Exit(1)
+// validateIdent checks an author, committer or tagger line value of the
+// form "Name <email> timestamp timezone".
+func validateIdent(ident string) error {
+	open := strings.IndexByte(ident, '<')
+	closing := strings.IndexByte(ident, '>')
+	if open < 0 || closing < open {
+		return fmt.Errorf("malformed ident: %s", ident)
 	}
-	defer f.Close()
-	r, err := zlib.NewReader(f)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading zlib data: %s\n", err)
-		os.Exit(1)
+	fields := strings.Fields(ident[closing+1:])
+	if len(fields) != 2 {
+		return fmt.Errorf("missing date in ident: %s", ident)
 	}
-	defer r.Close()
-	br := bufio.NewReader(r)
-	_, err = br.ReadBytes('\x00') // discard header 'tree <length>\x00'
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading header: %s\n", err)
-		os.Exit(1)
+	if _, err := strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return fmt.Errorf("bad date in ident: %s", ident)
+	}
+	tz := fields[1]
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') {
+		return fmt.Errorf("bad timezone in ident: %s", ident)
 	}
+	if _, err := strconv.ParseUint(tz[1:], 10, 64); err != nil {
+		return fmt.Errorf("bad timezone in ident: %s", ident)
+	}
+	return nil
+}
+
+func validateTree(data []byte) error {
+	reader := bufio.NewReader(bytes.NewReader(data))
 	for {
-		entry, err := nextTreeEntry(br)
+		mode, err := reader.ReadString(' ')
+		if err == io.EOF && mode == "" {
+			return nil
+		}
+		if err != nil {
+			return errors.New("truncated tree entry")
+		}
+		mode = mode[:len(mode)-1]
+		switch mode {
+		case "100644", "100755", "120000", "40000", "160000":
+		default:
+			return fmt.Errorf("invalid tree entry mode: %q", mode)
+		}
+		name, err := reader.ReadString(0)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			return errors.New("truncated tree entry")
+		}
+		name = name[:len(name)-1]
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid tree entry name: %q", name)
+		}
+		if _, err := io.ReadFull(reader, make([]byte, 20)); err != nil {
+			return errors.New("truncated tree entry")
+		}
+	}
+}
+
+// validateHeaders checks that the header lines of a commit or tag, up to
+// the first empty line, start with the required fields in order.
+func validateHeaders(data []byte, required []string) error {
+	headers, _, _ := bytes.Cut(data, []byte("\n\n"))
+	lines := strings.Split(string(headers), "\n")
+	i := 0
+	for _, field := range required {
+		optional := strings.HasSuffix(field, "*")
+		field = strings.TrimSuffix(field, "*")
+		for {
+			if i >= len(lines) {
+				if optional {
+					break
+				}
+				return fmt.Errorf("missing %s header", field)
+			}
+			value, ok := strings.CutPrefix(lines[i], field+" ")
+			if !ok {
+				if optional {
+					break
+				}
+				return fmt.Errorf("missing %s header", field)
+			}
+			switch field {
+			case "tree", "parent", "object":
+				if !isObjectSha(value) {
+					return fmt.Errorf("invalid %s: %s", field, value)
+				}
+			case "author", "committer", "tagger":
+				if err := validateIdent(value); err != nil {
+					return err
+				}
+			case "type":
+				if value != "blob" && value != "tree" && value != "commit" && value != "tag" {
+					return fmt.Errorf("invalid type: %s", value)
+				}
+			}
+			i++
+			if field != "parent" {
 				break
-			} else {
-				fmt.Fprintf(os.Stderr, "Error reading tree object: %s\n", err)
-				os.Exit(1)
 			}
 		}
-		fmt.Println(entry.name)
 	}
-	return 0
+	return nil
 }
 
-func shaData(data []byte) [20]byte {
-	return sha1.Sum(data)
+// validateObject checks that data is well-formed for objType before it is
+// hashed, like git does unless --literally is given.
+func validateObject(objType string, data []byte) error {
+	switch objType {
+	case "blob":
+		return nil
+	case "tree":
+		return validateTree(data)
+	case "commit":
+		return validateHeaders(data, []string{"tree", "parent*", "author", "committer"})
+	case "tag":
+		return validateHeaders(data, []string{"object", "type", "tag", "tagger*"})
+	default:
+		return fmt.Errorf("invalid object type: %s", objType)
+	}
 }
 
-func writeObject(t string, data []byte) ([20]byte, string) {
-	header := fmt.Sprintf("%s %d\x00", t, len(data))
-	storeContents := append([]byte(header), data...)
-	hashKeyBytes := shaData(storeContents)
-	hashKey := hex.EncodeToString(hashKeyBytes[:])
-	if len(hashKey) != 40 {
-		fmt.Fprintf(os.Stderr, "length hash key=%d invalid\n", len(hashKey))
-		os.Exit(1)
+// hashInput hashes the contents of reader, or of the file at filename
+// when reader is nil.
+func hashInput(objType, filename string, reader io.Reader, write bool) (string, error) {
+	if reader == nil && objType == "blob" {
+		s, err := os.Stat(filename)
+		if err != nil {
+			return "", err
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return hashStream(objType, s.Size(), f, write)
 	}
-	dir := fmt.Sprintf(".git/objects/%s", hashKey[:2])
-	filePath := fmt.Sprintf("%s/%s", dir, hashKey[2:])
-	if err := os.MkdirAll(string(dir), 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "mkdir %s got err=%v\n", string(dir), err)
-		os.Exit(1)
+	var data []byte
+	var err error
+	if reader != nil {
+		data, err = io.ReadAll(reader)
+	} else {
+		data, err = os.ReadFile(filename)
 	}
-	var buf bytes.Buffer
-	zWriter := zlib.NewWriter(&buf)
-	_, err := zWriter.Write(storeContents)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "write zlib to buffer got err=%v\n", err)
-		os.Exit(1)
+		return "", err
 	}
-	zWriter.Close()
-	err = os.WriteFile(filePath, buf.Bytes(), 0755)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "write content to file=%s got err=%v\n", filePath, err)
-		os.Exit(1)
+	if err := validateObject(objType, data); err != nil {
+		return "", err
 	}
-	return hashKeyBytes, hashKey
+	return hashStream(objType, int64(len(data)), bytes.NewReader(data), write)
 }
 
-func writeTree(path string) ([20]byte, string) {
-	dirInfos, err := os.ReadDir(path)
-	if err != nil {
-		fmt.Printf("Err: %v", err)
-		os.Exit(1)
+func hashObject(args []string) int {
+	objType := "blob"
+	write, fromStdin, stdinPaths := false, false, false
+	filenames := []string{}
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "-w":
+			write = true
+		case "--stdin":
+			fromStdin = true
+		case "--stdin-paths":
+			stdinPaths = true
+		case "-t":
+			if i+1 >= len(args) {
+				fmt.Fprintf(os.Stderr, "option -t requires a value\n")
+				return 1
+			}
+			i++
+			objType = args[i]
+		case "--":
+			filenames = append(filenames, args[i+1:]...)
+			i = len(args)
+		default:
+			if strings.HasPrefix(arg, "-") {
+				fmt.Fprintf(os.Stderr, "Unknown option %s\n", arg)
+				return 1
+			}
+			filenames = append(filenames, arg)
+		}
 	}
-	entries := []string{}
-	for _, item := range dirInfos {
-		if item.Name() == ".git" {
-			continue
+	if fromStdin && stdinPaths {
+		fmt.Fprintf(os.Stderr, "Can't use --stdin-paths with --stdin\n")
+		return 1
+	}
+	if stdinPaths && len(filenames) > 0 {
+		fmt.Fprintf(os.Stderr, "Can't specify files with --stdin-paths\n")
+		return 1
+	}
+	if !fromStdin && !stdinPaths && len(filenames) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: mygit hash-object [-t <type>] [-w] [--stdin | --stdin-paths] [--] <file>...\n")
+		return 1
+	}
+	switch objType {
+	case "blob", "tree", "commit", "tag":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid object type: %s\n", objType)
+		return 1
+	}
+
+	hashOne := func(filename string, reader io.Reader) bool {
+		sha, err := hashInput(objType, filename, reader, write)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error hashing %s: %s\n", filename, err)
+			return false
 		}
-		if item.IsDir() {
-			hash, _ := writeTree(filepath.Join(path, item.Name()))
-			row := fmt.Sprintf("40000 %s\x00%s", item.Name(), hash)
-			entries = append(entries, row)
-		} else {
-			contentFile, err := os.ReadFile(filepath.Join(path, item.Name()))
-			if err != nil {
-				fmt.Printf("Err: %v", err)
-				os.Exit(1)
+		fmt.Println(sha)
+		return true
+	}
+	if fromStdin && !hashOne("<stdin>", os.Stdin) {
+		return 1
+	}
+	if stdinPaths {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if !hashOne(scanner.Text(), nil) {
+				return 1
 			}
-			hashKey, _ := writeObject("blob", contentFile)
-			row := fmt.Sprintf("100644 %s\x00%s", item.Name(), hashKey)
-			entries = append(entries, row)
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading stdin: %s\n", err)
+			return 1
 		}
 	}
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i][strings.IndexByte(entries[i], ' ')+1:] < entries[j][strings.IndexByte(entries[i], ' ')+1:]
-	})
-	var buffer bytes.Buffer
-	for _, e := range entries {
-		buffer.WriteString(e)
+	for _, filename := range filenames {
+		if !hashOne(filename, nil) {
+			return 1
+		}
 	}
-	return writeObject("tree", buffer.Bytes())
+	return 0
 }
 
-func commit(treeHash, parentHash, msg string) string {
-	sb := strings.Builder{}
-	sb.WriteString("tree " + treeHash + "\n")
-	sb.WriteString("parent " + parentHash + "\n")
-	sb.WriteString("\n" + msg + "\n")
-
-	hashKeyBytes := shaData([]byte(sb.String()))
-	hashKey := hex.EncodeToString(hashKeyBytes[:])
-	header := fmt.Sprintf("commit %d\x00", sb.Len())
-	storeContents := append([]byte(header), []byte(sb.String())...)
-	dir := fmt.Sprintf(".git/objects/%s", hashKey[:2])
-	filePath := fmt.Sprintf("%s/%s", dir, hashKey[2:])
-
-	if err := os.MkdirAll(string(dir), 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "mkdir %s got err=%v\n", string(dir), err)
-		os.Exit(1)
+// treeEntryType returns the object type a tree entry with mode points to.
+func treeEntryType(mode string) string {
+	switch mode {
+	case "40000", "040000":
+		return "tree"
+	case "160000":
+		return "commit"
+	default:
+		return "blob"
 	}
+}
 
-	var buf bytes.Buffer
-	zWriter := zlib.NewWriter(&buf)
-	_, err := zWriter.Write(storeContents)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "write zlib to buffer got err=%v\n", err)
-		os.Exit(1)
-	}
-	zWriter.Close()
-	err = os.WriteFile(filePath, buf.Bytes(), 0755)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "write content to file=%s got err=%v\n", filePath, err)
-		os.Exit(1)
-	}
-	pathCommit := filepath.Join(".git", "refs", "heads", "master")
-	content := hashKey + "\n"
-	err = os.WriteFile(pathCommit, []byte(content), 0755)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "write data to commit file=%s got err=%v\n", pathCommit, err)
-		os.Exit(1)
+// formatTreeEntry formats a tree entry the way git prints it in cat-file -p
+// and ls-tree, with the mode padded to six digits.
+func formatTreeEntry(mode, sha, name string) string {
+	if len(mode) < 6 {
+		mode = strings.Repeat("0", 6-len(mode)) + mode
 	}
-	return hashKey
+	return fmt.Sprintf("%s %s %s\t%s", mode, treeEntryType(mode), sha, name)
 }
 
-func initGitRepository(repoPath string) error {
-	for _, dir := range []string{".git", ".git/objects", ".git/refs"} {
-		dirPath := path.Join(repoPath, dir)
-		if err := os.Mkdir(dirPath, 0755); err != nil && !os.IsExist(err) {
-			return err
+// catFileBatch reads object names from stdin, one per line, and writes
+// "<sha> <type> <size>" for each of them, followed by the contents when
+// withContents is set. Unknown objects are reported as "<name> missing".
+func catFileBatch(withContents bool) int {
+	scanner := bufio.NewScanner(os.Stdin)
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+	for scanner.Scan() {
+		object := scanner.Text()
+		objectSha, err := resolveRevision(".", object)
+		if err != nil {
+			fmt.Fprintf(writer, "%s missing\n", object)
+			writer.Flush()
+			continue
+		}
+		objReader, err := NewGitObjectReader(".", objectSha)
+		if err != nil {
+			// a full object id resolves whether or not the object exists
+			if errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(writer, "%s missing\n", object)
+				writer.Flush()
+				continue
+			}
+			writer.Flush()
+			fmt.Fprintf(os.Stderr, "Error reading object %s: %s\n", objectSha, err)
+			return 1
+		}
+		fmt.Fprintf(writer, "%s %s %d\n", objReader.Sha, objReader.Type, objReader.ContentSize)
+		if withContents {
+			contents, err := objReader.ReadContents()
+			objReader.Close()
+			if err != nil {
+				writer.Flush()
+				fmt.Fprintf(os.Stderr, "Error reading object %s: %s\n", objectSha, err)
+				return 1
+			}
+			writer.Write(contents)
+			writer.WriteByte('\n')
+		} else {
+			objReader.Close()
+		}
+		// flush every record so callers can interleave requests and replies
+		if err := writer.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %s\n", err)
+			return 1
 		}
 	}
-	headFileContents := []byte("ref: refs/heads/master\n")
-	headPath := path.Join(repoPath, ".git/HEAD")
-	if err := os.WriteFile(headPath, headFileContents, 0644); err != nil {
-		return err
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading stdin: %s\n", err)
+		return 1
 	}
-	return nil
+	return 0
 }
 
-func readPacketLine(reader io.Reader) ([]byte, error) {
-	hex := make([]byte, 4)
-	if _, err := reader.Read(hex); err != nil {
-		return []byte{}, err
+func catFile(args []string) int {
+	if len(args) == 1 && (args[0] == "--batch" || args[0] == "--batch-check") {
+		return catFileBatch(args[0] == "--batch")
 	}
-
-	size, err := strconv.ParseInt(string(hex), 16, 64)
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: mygit cat-file (-t | -s | -e | -p) <object>\n")
+		fmt.Fprintf(os.Stderr, "   or: mygit cat-file (--batch | --batch-check) < <list-of-objects>\n")
+		return 1
+	}
+	option, object := args[0], args[1]
+	objectSha, err := resolveRevision(".", object)
 	if err != nil {
-		return []byte{}, err
+		if option != "-e" {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+		return 1
 	}
-	if size == 0 {
-		return []byte{}, nil
+	objReader, err := NewGitObjectReader(".", objectSha)
+	if option == "-e" {
+		if err != nil {
+			return 1
+		}
+		objReader.Close()
+		return 0
 	}
-
-	buf := make([]byte, size-4)
-	if _, err := reader.Read(buf); err != nil {
-		return []byte{}, err
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading object %s: %s\n", objectSha, err)
+		return 1
+	}
+	defer objReader.Close()
+
+	switch option {
+	case "-t":
+		fmt.Println(objReader.Type)
+	case "-s":
+		fmt.Println(objReader.ContentSize)
+	case "-p":
+		contents, err := objReader.ReadContents()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading object %s: %s\n", objectSha, err)
+			return 1
+		}
+		if objReader.Type != "tree" {
+			os.Stdout.Write(contents)
+			return 0
+		}
+		tree, err := parseTree(contents)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading tree object: %s\n", err)
+			return 1
+		}
+		for _, child := range tree.children {
+			fmt.Println(formatTreeEntry(child.mode, child.sha, child.name))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown option %s\n", option)
+		return 1
 	}
+	return 0
+}
 
-	return buf, nil
+type lsTreeOptions struct {
+	recursive bool
+	showTrees bool
+	long      bool
+	nameOnly  bool
+	paths     []string
 }
 
-func fetchLatestCommit(gitUrl string) (string, error) {
-	url := fmt.Sprintf("%s/info/refs?service=git-upload-pack", gitUrl)
-	res, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	buf := bytes.NewBuffer([]byte{})
-	if _, err := io.Copy(buf, res.Body); err != nil {
-		return "", err
+// lsTreeMatch decides whether the entry at entryPath is printed and whether
+// ls-tree descends into it. A filter ending in "/" lists the contents of
+// that directory, and directories leading up to a filter are always
+// descended into.
+func (o *lsTreeOptions) lsTreeMatch(entryPath string, isTree bool) (bool, bool) {
+	if len(o.paths) == 0 {
+		return true, isTree && o.recursive
+	}
+	show, descend := false, false
+	for _, filter := range o.paths {
+		filterPath := strings.TrimSuffix(filter, "/")
+		switch {
+		case entryPath == filterPath || filterPath == "" || filterPath == ".":
+			if isTree && strings.HasSuffix(filter, "/") && entryPath == filterPath {
+				descend = true
+			} else {
+				show = true
+				descend = descend || (isTree && o.recursive)
+			}
+		case strings.HasPrefix(entryPath, filterPath+"/"):
+			show = true
+			descend = descend || (isTree && o.recursive)
+		case isTree && strings.HasPrefix(filterPath, entryPath+"/"):
+			descend = true
+		}
 	}
-	reader := bufio.NewReader(buf)
+	return show, descend
+}
 
-	if _, err := readPacketLine(reader); err != nil {
-		return "", err
+func (o *lsTreeOptions) printEntry(child TreeChild, entryPath string) error {
+	if o.nameOnly {
+		fmt.Println(entryPath)
+		return nil
 	}
-
-	if _, err := readPacketLine(reader); err != nil {
-		return "", err
+	if !o.long {
+		fmt.Println(formatTreeEntry(child.mode, child.sha, entryPath))
+		return nil
 	}
-
-	head, err := readPacketLine(reader)
-	if err != nil {
-		return "", err
+	size := "-"
+	if treeEntryType(child.mode) == "blob" {
+		objReader, err := NewGitObjectReader(".", child.sha)
+		if err != nil {
+			return err
+		}
+		objReader.Close()
+		size = strconv.FormatInt(objReader.ContentSize, 10)
 	}
-
-	split := strings.Split(string(head), " ")
-	return split[0], nil
+	mode := strings.Repeat("0", 6-len(child.mode)) + child.mode
+	fmt.Printf("%s %s %s %7s\t%s\n", mode, treeEntryType(child.mode), child.sha, size, entryPath)
+	return nil
 }
 
-func writeBranchRefFile(repoPath string, branch string, commit string) error {
-	refPath := path.Join(repoPath, ".git", "refs", "heads", branch)
-	if err := os.MkdirAll(path.Dir(refPath), 0750); err != nil && !os.IsExist(err) {
+func (o *lsTreeOptions) walk(treeSha, prefix string) error {
+	treeBuf, err := readObjectContent(".", treeSha)
+	if err != nil {
 		return err
 	}
-	refFileContents := []byte(commit)
-	if err := os.WriteFile(refPath, refFileContents, 0644); err != nil {
+	tree, err := parseTree(treeBuf)
+	if err != nil {
 		return err
 	}
+	for _, child := range tree.children {
+		entryPath := prefix + child.name
+		isTree := treeEntryType(child.mode) == "tree"
+		show, descend := o.lsTreeMatch(entryPath, isTree)
+		// trees that are descended into are only listed with -t
+		if (show && !descend) || (descend && o.showTrees) {
+			if err := o.printEntry(child, entryPath); err != nil {
+				return err
+			}
+		}
+		if descend {
+			if err := o.walk(child.sha, entryPath+"/"); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-// start of fetch object package
-func packetLine(rawLine string) string {
-	size := len(rawLine) + 4
-	return fmt.Sprintf("%04x%s", size, rawLine)
-}
-
-func fetchPacketFile(gitUrl, commitSha string) []byte {
-	buf := bytes.NewBuffer([]byte{})
-
-	buf.WriteString(packetLine(fmt.Sprintf("want %s no-progress\n", commitSha)))
-	buf.WriteString("0000")
-	buf.WriteString(packetLine("done\n"))
-
-	uploadPackUrl := fmt.Sprintf("%s/git-upload-pack", gitUrl)
-	resp, err := http.Post(uploadPackUrl, "", buf)
-	if err != nil {
-		fmt.Printf("[Error] Error in git-upload-pack request: %v\n", err)
+func lsTree(args []string) int {
+	opts := lsTreeOptions{}
+	treeIsh := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-r":
+			opts.recursive = true
+		case arg == "-t":
+			opts.showTrees = true
+		case arg == "-l" || arg == "--long":
+			opts.long = true
+		case arg == "--name-only" || arg == "--name-status":
+			opts.nameOnly = true
+		case arg == "--" && treeIsh != "":
+			opts.paths = append(opts.paths, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			fmt.Fprintf(os.Stderr, "Unknown option %s\n", arg)
+			return 1
+		case treeIsh == "":
+			treeIsh = arg
+		default:
+			opts.paths = append(opts.paths, arg)
+		}
 	}
-	result := bytes.NewBuffer([]byte{})
-	if _, err := io.Copy(result, resp.Body); err != nil {
-		fmt.Printf("err: %v", err)
+	if treeIsh == "" {
+		fmt.Fprintf(os.Stderr, "usage: mygit ls-tree [-r] [-t] [-l] [--name-only] <tree-ish> [<path>...]\n")
+		return 1
 	}
 
-	packetFileBuf := result.Bytes()[8:]
-	return packetFileBuf
-}
-
-// start of read object package
-func readObjectTypeAndLen(reader *bytes.Reader) (byte, int, error) {
-	num := 0
-	b, err := reader.ReadByte()
+	sha, err := resolveRevision(".", treeIsh)
 	if err != nil {
-		return 0, 0, err
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
 	}
-	objType := (b & objMask) >> 4
-	num += int(b & firstRemMask)
-	if (b & msbMask) == 0 {
-		return objType, num, nil
+	treeSha, err := peelToTree(".", sha)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
 	}
-	i := 0
-	for {
-		b, err := reader.ReadByte()
-		if err != nil {
-			return 0, 0, err
-		}
-		num += int(b) << (4 + 7*i)
-		if (b & msbMask) == 0 {
-			break
-		}
-		i++
+	if err := opts.walk(treeSha, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading tree object: %s\n", err)
+		return 1
 	}
-
-	return objType, num, nil
+	return 0
 }
 
-func readSha(reader io.Reader) (string, error) {
-	sha := make([]byte, 20)
-	if _, err := reader.Read(sha); err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%x", sha), nil
+func shaData(data []byte) [20]byte {
+	return sha1.Sum(data)
 }
 
-func decompressObject(reader *bytes.Reader) (*bytes.Buffer, error) {
-	decompressedReader, err := zlib.NewReader(reader)
-	if err != nil {
-		return nil, err
+func writeObject(t string, data []byte) ([20]byte, string) {
+	header := fmt.Sprintf("%s %d\x00", t, len(data))
+	storeContents := append([]byte(header), data...)
+	hashKeyBytes := shaData(storeContents)
+	hashKey := hex.EncodeToString(hashKeyBytes[:])
+	if len(hashKey) != 40 {
+		fmt.Fprintf(os.Stderr, "length hash key=%d invalid\n", len(hashKey))
+		os.Exit(1)
 	}
-	decompressed := bytes.NewBuffer([]byte{})
-	if _, err := io.Copy(decompressed, decompressedReader); err != nil {
-		return nil, err
+	dir := fmt.Sprintf(".git/objects/%s", hashKey[:2])
+	filePath := fmt.Sprintf("%s/%s", dir, hashKey[2:])
+	if err := os.MkdirAll(string(dir), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "mkdir %s got err=%v\n", string(dir), err)
+		os.Exit(1)
 	}
-	return decompressed, nil
-}
-
-func readDeltified(reader *bytes.Buffer, baseObj *Object) (*bytes.Buffer, error) {
-	_, err := binary.ReadUvarint(reader)
+	var buf bytes.Buffer
+	zWriter := zlib.NewWriter(&buf)
+	_, err := zWriter.Write(storeContents)
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(os.Stderr, "write zlib to buffer got err=%v\n", err)
+		os.Exit(1)
 	}
-
-	dstObjLen, err := binary.ReadUvarint(reader)
+	zWriter.Close()
+	err = os.WriteFile(filePath, buf.Bytes(), 0755)
 	if err != nil {
-		return nil, err
-	}
-
-	result := bytes.NewBuffer([]byte{})
-	for reader.Len() > 0 {
-		firstByte, err := reader.ReadByte()
-		if err != nil {
-			return nil, err
-		}
-
-		if (firstByte & msbMask) == 0 {
-			n := int64(firstByte & remMask)
-			if _, err := io.CopyN(result, reader, n); err != nil {
-				return nil, err
-			}
-		} else {
-			offset := 0
-			size := 0
-			for i := 0; i < 4; i++ {
-				if (firstByte>>i)&1 > 0 {
-					b, err := reader.ReadByte()
-					if err != nil {
-						return nil, err
-					}
-					offset += int(b) << (i * 8)
-				}
-			}
-
-			for i := 4; i < 7; i++ {
-				if (firstByte>>i)&1 > 0 {
-					b, err := reader.ReadByte()
-					if err != nil {
-						return nil, err
-					}
-					size += int(b) << ((i - 4) * 8)
-				}
-			}
-
-			if _, err := result.Write(baseObj.Buf[offset : offset+size]); err != nil {
-				return nil, err
-			}
-		}
-	}
-	if result.Len() != int(dstObjLen) {
-		return nil, fmt.Errorf("invalid deltified buf: expected: %d, but got: %d", dstObjLen, result.Len())
+		fmt.Fprintf(os.Stderr, "write content to file=%s got err=%v\n", filePath, err)
+		os.Exit(1)
 	}
-	return result, nil
+	return hashKeyBytes, hashKey
 }
 
-func (o *Object) typeString() (string, error) {
-	switch o.Type {
-	case objCommit:
-		return "commit", nil
-	case objTree:
-		return "tree", nil
-	case objBlob:
-		return "blob", nil
-	default:
-		return "", fmt.Errorf("invalid type: %d", o.Type)
+// emptyTreeSha is the id of the tree without entries. Git never records
+// empty directories, so such trees are left out of their parent.
+const emptyTreeSha = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// treeSortKey orders tree entries the way git does: subtrees sort as if
+// their name ended with a slash.
+func treeSortKey(child TreeChild) string {
+	if child.mode == "40000" {
+		return child.name + "/"
 	}
+	return child.name
 }
 
-func wrapper(contents []byte, objectType string) (*bytes.Buffer, error) {
-	outerContents := bytes.NewBuffer([]byte{})
-	outerContents.WriteString(fmt.Sprintf("%s %d\x00", objectType, len(contents)))
-	if _, err := io.Copy(outerContents, bytes.NewReader(contents)); err != nil {
-		return nil, err
+func serializeTree(children []TreeChild) []byte {
+	sort.Slice(children, func(i, j int) bool {
+		return treeSortKey(children[i]) < treeSortKey(children[j])
+	})
+	var buffer bytes.Buffer
+	for _, child := range children {
+		sha, _ := hex.DecodeString(child.sha)
+		buffer.WriteString(fmt.Sprintf("%s %s\x00", child.mode, child.name))
+		buffer.Write(sha)
 	}
-	return outerContents, nil
+	return buffer.Bytes()
 }
 
-func (o *Object) wrappedBuf() ([]byte, error) {
-	t, err := o.typeString()
-	if err != nil {
-		return []byte{}, err
+// fileTreeChild hashes the non-directory item at itemPath into a blob and
+// returns its tree entry: symlinks store their target with mode 120000
+// and files with the owner executable bit set get mode 100755.
+func fileTreeChild(item os.DirEntry, itemPath string) TreeChild {
+	if item.Type()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(itemPath)
+		if err != nil {
+			fmt.Printf("Err: %v", err)
+			os.Exit(1)
+		}
+		_, hashKey := writeObject("blob", []byte(target))
+		return TreeChild{mode: "120000", name: item.Name(), sha: hashKey}
 	}
-	wrappedBuf, err := wrapper(o.Buf, t)
+	info, err := item.Info()
 	if err != nil {
-		return []byte{}, err
+		fmt.Printf("Err: %v", err)
+		os.Exit(1)
 	}
-	return wrappedBuf.Bytes(), nil
-}
-
-func (o *Object) sha() (string, error) {
-	b, err := o.wrappedBuf()
-	if err != nil {
-		return "", err
+	mode := "100644"
+	if info.Mode()&0100 != 0 {
+		mode = "100755"
 	}
-	return fmt.Sprintf("%x", sha1.Sum(b)), nil
-}
-
-func saveObject(o *Object) error {
-	objSha, err := o.sha()
+	contentFile, err := os.ReadFile(itemPath)
 	if err != nil {
-		return err
+		fmt.Printf("Err: %v", err)
+		os.Exit(1)
 	}
-	shaToObj[objSha] = *o
-	return nil
+	_, hashKey := writeObject("blob", contentFile)
+	return TreeChild{mode: mode, name: item.Name(), sha: hashKey}
 }
 
-func readObject(reader *bytes.Reader) error {
-	objType, objLen, err := readObjectTypeAndLen(reader)
+// writeTree snapshots the working tree directory path, which is relative
+// to the repository root, leaving out the paths matcher ignores.
+func writeTree(path string, matcher *IgnoreMatcher) ([20]byte, string) {
+	dirInfos, err := os.ReadDir(path)
 	if err != nil {
-		return err
+		fmt.Printf("Err: %v", err)
+		os.Exit(1)
 	}
-	if objType == objRefDelta {
-		baseObjSha, err := readSha(reader)
-		if err != nil {
-			return err
-		}
-		baseObj, ok := shaToObj[baseObjSha]
-		if !ok {
-			return fmt.Errorf("unknown obj sha: %s", baseObjSha)
-		}
-		decompressed, err := decompressObject(reader)
-		if err != nil {
-			return err
-		}
-		deltified, err := readDeltified(decompressed, &baseObj)
-		if err != nil {
-			return err
-		}
-		obj := Object{
-			Type: baseObj.Type,
-			Buf:  deltified.Bytes(),
-		}
-		if err := saveObject(&obj); err != nil {
-			return err
+	children := []TreeChild{}
+	for _, item := range dirInfos {
+		if item.Name() == ".git" {
+			continue
 		}
-	} else if objType == objOfsDelta {
-		return errors.New("Unsupported")
-	} else {
-		decompressed, err := decompressObject(reader)
-		if err != nil {
-			return err
+		itemPath := filepath.Join(path, item.Name())
+		if matcher.isIgnored(filepath.ToSlash(itemPath), item.IsDir()) {
+			continue
 		}
-		if objLen != decompressed.Len() {
-			return fmt.Errorf("expect object length: %d, but get: %d", objLen, decompressed.Len())
+		if !item.IsDir() {
+			children = append(children, fileTreeChild(item, itemPath))
+			continue
 		}
-		obj := Object{
-			Type: objType,
-			Buf:  decompressed.Bytes(),
+		if _, err := os.Stat(filepath.Join(itemPath, ".git")); err == nil {
+			// nested repository, recorded as a gitlink to its HEAD commit
+			commitSha, err := readRef(itemPath, "HEAD")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: '%s' does not have a commit checked out\n", itemPath)
+				os.Exit(1)
+			}
+			children = append(children, TreeChild{mode: "160000", name: item.Name(), sha: commitSha})
+			continue
 		}
-		if err := saveObject(&obj); err != nil {
-			return err
+		_, hash := writeTree(itemPath, matcher)
+		if hash != emptyTreeSha {
+			children = append(children, TreeChild{mode: "40000", name: item.Name(), sha: hash})
 		}
 	}
-	return nil
+	return writeObject("tree", serializeTree(children))
 }
 
-// end of read object package
-
-func fetchObjects(gitRepositoryUrl, commitSha string) error {
-	packetFileBuffer := fetchPacketFile(gitRepositoryUrl, commitSha)
-	checksumLen := 20
-	calculatedChecksum := packetFileBuffer[len(packetFileBuffer)-checksumLen:]
-	storedChecksum := sha1.Sum(packetFileBuffer[:len(packetFileBuffer)-checksumLen])
-	if !bytes.Equal(storedChecksum[:], calculatedChecksum) {
-		fmt.Printf("[Error] expected checksum: %v, but got: %v", storedChecksum, calculatedChecksum)
-	}
-
-	headerLen := 12
-	bufReader := bytes.NewReader(packetFileBuffer[headerLen:])
-	for {
-		err := readObject(bufReader)
-		if err != nil {
+// defaultRepositoryConfig is the config file written by init, matching
+// the one git creates for a non-bare repository.
+const defaultRepositoryConfig = `[core]
+	repositoryformatversion = 0
+	filemode = true
+	bare = false
+	logallrefupdates = true
+`
+
+// initGitRepository creates the .git directory of repoPath. HEAD points
+// to init.defaultBranch, or master when it is not configured. Running it
+// again leaves an existing HEAD and config alone.
+func initGitRepository(repoPath string) error {
+	for _, dir := range []string{".git", ".git/objects", ".git/refs", ".git/refs/heads", ".git/refs/tags"} {
+		dirPath := path.Join(repoPath, dir)
+		if err := os.Mkdir(dirPath, 0755); err != nil && !os.IsExist(err) {
 			return err
 		}
-		if bufReader.Len() <= checksumLen {
-			fmt.Printf("[Debug] remaining buf len: %d\n", bufReader.Len())
-			break
-		}
 	}
-	return nil
-}
-
-// end of fetch object package
-
-func writeGitObject(repoPath string, object []byte) (string, error) {
-	blobSha := fmt.Sprintf("%x", sha1.Sum(object))
-	objectFilePath := path.Join(repoPath, ".git", "objects", blobSha[:2], blobSha[2:])
-	if err := os.MkdirAll(path.Dir(objectFilePath), 0755); err != nil {
-		return "", err
-	}
-	objectFile, err := os.Create(objectFilePath)
+	userConfig, err := loadConfig("")
 	if err != nil {
-		return "", err
-	}
-	compressedFileWriter := zlib.NewWriter(objectFile)
-	if _, err = compressedFileWriter.Write(object); err != nil {
-		return "", err
+		return err
 	}
-	if err := compressedFileWriter.Close(); err != nil {
-		return "", err
+	branch, ok := userConfig.get("init.defaultBranch")
+	if !ok || branch == "" {
+		branch = "master"
 	}
-	return blobSha, nil
-}
-
-func writeFetchedObjects(repoPath string) error {
-	for _, object := range shaToObj {
-		b, err := object.wrappedBuf()
-		if err != nil {
+	headPath := path.Join(repoPath, ".git/HEAD")
+	if _, err := os.Stat(headPath); os.IsNotExist(err) {
+		headFileContents := []byte("ref: refs/heads/" + branch + "\n")
+		if err := os.WriteFile(headPath, headFileContents, 0644); err != nil {
 			return err
 		}
-		if _, err := writeGitObject(repoPath, b); err != nil {
+	}
+	configPath := path.Join(repoPath, ".git/config")
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		if err := os.WriteFile(configPath, []byte(defaultRepositoryConfig), 0644); err != nil {
 			return err
 		}
 	}
@@ -671,42 +784,80 @@ func writeFetchedObjects(repoPath string) error {
 }
 
 // start of restore repository package
+// NewGitObjectReader opens objectSha as a loose object, falling back to
+// the packs of the repository when there is no loose copy.
 func NewGitObjectReader(repoPath, objectSha string) (GitObjectReader, error) {
+	if len(objectSha) != 40 {
+		return GitObjectReader{}, fmt.Errorf("invalid object name: %s", objectSha)
+	}
 	objectFilePath := path.Join(repoPath, ".git", "objects", objectSha[:2], objectSha[2:])
 	objectFile, err := os.Open(objectFilePath)
+	if os.IsNotExist(err) {
+		return newPackedObjectReader(repoPath, objectSha)
+	}
 	if err != nil {
 		return GitObjectReader{}, err
 	}
 	objectFileDecompressed, err := zlib.NewReader(objectFile)
 	if err != nil {
+		objectFile.Close()
 		return GitObjectReader{}, err
 	}
 	objectFileReader := bufio.NewReader(objectFileDecompressed)
 
 	objectType, err := objectFileReader.ReadString(' ')
 	if err != nil {
+		objectFile.Close()
 		return GitObjectReader{}, err
 	}
 	objectType = objectType[:len(objectType)-1]
 
 	objectSizeStr, err := objectFileReader.ReadString(0)
 	if err != nil {
+		objectFile.Close()
 		return GitObjectReader{}, err
 	}
 
 	objectSizeStr = objectSizeStr[:len(objectSizeStr)-1]
 	size, err := strconv.ParseInt(objectSizeStr, 10, 64)
 	if err != nil {
+		objectFile.Close()
 		return GitObjectReader{}, err
 	}
 
 	return GitObjectReader{
 		objectFileReader: objectFileReader,
+		closer:           objectFile,
 		Type:             objectType,
 		Sha:              objectSha,
 		ContentSize:      size,
 	}, nil
 }
+func newPackedObjectReader(repoPath, objectSha string) (GitObjectReader, error) {
+	obj, err := readPackedObject(repoPath, objectSha)
+	if err != nil {
+		return GitObjectReader{}, err
+	}
+	objectType, err := obj.typeString()
+	if err != nil {
+		return GitObjectReader{}, err
+	}
+	return GitObjectReader{
+		objectFileReader: bufio.NewReader(bytes.NewReader(obj.Buf)),
+		Type:             objectType,
+		Sha:              objectSha,
+		ContentSize:      int64(len(obj.Buf)),
+	}, nil
+}
+
+// Close releases the file a loose object is read from.
+func (g *GitObjectReader) Close() error {
+	if g.closer == nil {
+		return nil
+	}
+	return g.closer.Close()
+}
+
 func (g *GitObjectReader) ReadContents() ([]byte, error) {
 	contents := make([]byte, g.ContentSize)
 	if _, err := io.ReadFull(g.objectFileReader, contents); err != nil {
@@ -720,6 +871,7 @@ func readObjectContent(repoPath, objSha string) ([]byte, error) {
 	if err != nil {
 		return []byte{}, err
 	}
+	defer objReader.Close()
 	contents, err := objReader.ReadContents()
 	if err != nil {
 		return []byte{}, err
@@ -744,7 +896,7 @@ func parseTree(treeBuf []byte) (*Tree, error) {
 		}
 		entryName = entryName[:len(entryName)-1]
 		sha := make([]byte, 20)
-		_, err = contentsReader.Read(sha)
+		_, err = io.ReadFull(contentsReader, sha)
 		if err != nil {
 			return nil, err
 		}
@@ -760,18 +912,23 @@ func parseTree(treeBuf []byte) (*Tree, error) {
 	return &tree, nil
 }
 
+// getPerm returns the permissions a regular file with mode is checked out
+// with. Only the owner executable bit is recorded by git, so every other
+// blob mode is written as a plain file.
 func getPerm(mode string) (os.FileMode, error) {
-	if !strings.HasPrefix(mode, "100") {
+	switch mode {
+	case "100755":
+		return 0755, nil
+	case "100644", "100664":
+		return 0644, nil
+	default:
 		return 0, fmt.Errorf("invalid mode: %s", mode)
 	}
-	perm, err := strconv.ParseInt(mode[3:], 8, 64)
-	if err != nil {
-		return 0, err
-	}
-	return os.FileMode(perm), nil
 }
 
-func traverseTree(repoPath, curDir, treeSha string) error {
+// traverseTree checks out the tree treeSha into curDir and adds an index
+// entry with the stat data of every file it writes to idx.
+func traverseTree(repoPath, curDir, treeSha string, idx *Index) error {
 	treeBuf, err := readObjectContent(repoPath, treeSha)
 	if err != nil {
 		return err
@@ -781,28 +938,64 @@ func traverseTree(repoPath, curDir, treeSha string) error {
 		return err
 	}
 	for _, child := range tree.children {
-		if strings.HasPrefix(child.mode, "100") {
-			blobBuf, err := readObjectContent(repoPath, child.sha)
+		if child.name == "" || child.name == "." || child.name == ".." || child.name == ".git" || strings.Contains(child.name, "/") {
+			return fmt.Errorf("invalid path in tree %s: %q", treeSha, child.name)
+		}
+		filePath := path.Join(repoPath, curDir, child.name)
+		entry := &IndexEntry{name: path.Join(curDir, child.name), sha: child.sha}
+		switch child.mode {
+		case "40000", "040000":
+			if err := traverseTree(repoPath, entry.name, child.sha, idx); err != nil {
+				return err
+			}
+			continue
+		case "160000":
+			// submodules are not fetched, only their directory is created
+			if err := os.MkdirAll(filePath, 0755); err != nil {
+				return err
+			}
+			entry.mode = indexModeGitlink
+		case "120000":
+			target, err := readObjectContent(repoPath, child.sha)
 			if err != nil {
 				return err
 			}
-			filePath := path.Join(repoPath, curDir, child.name)
 			if err := os.MkdirAll(path.Dir(filePath), 0750); err != nil && !os.IsExist(err) {
 				return err
 			}
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(string(target), filePath); err != nil {
+				return err
+			}
+			entry.mode = indexModeSymlink
+		default:
 			perm, err := getPerm(child.mode)
 			if err != nil {
 				return err
 			}
-			if err := os.WriteFile(filePath, blobBuf, perm); err != nil {
+			blobBuf, err := readObjectContent(repoPath, child.sha)
+			if err != nil {
 				return err
 			}
-		} else {
-			childDir := path.Join(curDir, child.name)
-			if err := traverseTree(repoPath, childDir, child.sha); err != nil {
+			if err := os.MkdirAll(path.Dir(filePath), 0750); err != nil && !os.IsExist(err) {
 				return err
 			}
+			if err := os.WriteFile(filePath, blobBuf, perm); err != nil {
+				return err
+			}
+			entry.mode = indexModeRegular
+			if perm == 0755 {
+				entry.mode = indexModeExecutable
+			}
 		}
+		info, err := os.Lstat(filePath)
+		if err != nil {
+			return err
+		}
+		fillStatData(entry, info)
+		idx.entries = append(idx.entries, entry)
 	}
 	return nil
 }
@@ -825,10 +1018,11 @@ func restoreRepository(repoPath, commitSha string) error {
 		return err
 	}
 	treeSha = treeSha[:len(treeSha)-1]
-	if err := traverseTree(repoPath, "", treeSha); err != nil {
+	idx := &Index{version: 2}
+	if err := traverseTree(repoPath, "", treeSha, idx); err != nil {
 		return err
 	}
-	return nil
+	return idx.write(repoPath)
 }
 
 // end of restore repository package
@@ -841,117 +1035,78 @@ func main() {
 
 	switch command := os.Args[1]; command {
 	case "init":
-		for _, dir := range []string{".git", ".git/objects", ".git/refs", ".git/refs/heads"} {
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				fmt.Fprintf(os.Stderr, "Error creating directory: %s\n", err)
-			}
-		}
-		headFileContents := []byte("ref: refs/heads/master\n")
-		if err := os.WriteFile(".git/HEAD", headFileContents, 0644); err != nil {
-			fmt.Fprintf(os.Stderr, "Error writing file: %s\n", err)
+		if err := initGitRepository("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing repository: %s\n", err)
+			os.Exit(1)
 		}
 		fmt.Println("Initialized git directory")
 
-	case "cat-file":
-		option := os.Args[2]
-		switch option {
-		case "-p":
-			blobSha := os.Args[3]
-			fpath := filepath.Join(".git/objects", blobSha[:2], blobSha[2:])
-			f, err := os.Open(fpath)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error opening %s: %s\n", fpath, err)
-				os.Exit(1)
-			}
-			zr, err := zlib.NewReader(f)
-			if err != nil {
-				fmt.Printf("Err: %v", err)
-			}
-			defer zr.Close()
+	case "config":
+		os.Exit(config(os.Args[2:]))
 
-			b, _ := io.ReadAll(zr)
-			fmt.Print(strings.Split(string(b), "\x00")[1])
-		default:
-			fmt.Fprintf(os.Stderr, "Unknown command %s\n", command)
-		}
+	case "cat-file":
+		os.Exit(catFile(os.Args[2:]))
 
 	case "hash-object":
-		if len(os.Args) < 4 {
-			fmt.Fprintf(os.Stderr, "usage: mygit hash-object -w <path-file>\n")
-			os.Exit(1)
-		}
-		filename := os.Args[3]
-		os.Exit(hashObject(filename))
+		os.Exit(hashObject(os.Args[2:]))
 
 	case "ls-tree":
-		if len(os.Args) < 4 {
-			fmt.Fprintf(os.Stderr, "usage: mygit hash-object -w <path-file>\n")
-			os.Exit(1)
-		}
-		sha := os.Args[3]
-		os.Exit(lsTree(sha))
+		os.Exit(lsTree(os.Args[2:]))
 
-	case "write-tree":
-		_, hash := writeTree(".")
-		fmt.Println(hash)
+	case "add":
+		os.Exit(addFiles(os.Args[2:]))
 
-	case "commit-tree":
-		if len(os.Args) < 7 {
-			fmt.Fprintf(os.Stderr, "usage: mygit commit-tree <tree_sha> -p <commit_sha> -m <message>\n")
-			os.Exit(1)
-		}
-		treeHash := os.Args[2]
-		parentSha := os.Args[4]
-		msg := os.Args[6]
-		hashCommit := commit(treeHash, parentSha, msg)
-		fmt.Println(hashCommit)
+	case "ls-files":
+		os.Exit(lsFiles(os.Args[2:]))
 
-	case "clone":
-		optsClone := os.Args[1]
-		if optsClone != "clone" {
-			fmt.Printf("Invalid argument: %v\n", os.Args[1:])
-			os.Exit(1)
-		}
+	case "status":
+		os.Exit(status(os.Args[2:]))
 
-		gitUrl := os.Args[2]
-		dir := os.Args[3]
-		repoPath := path.Join(".", dir)
+	case "check-ignore":
+		os.Exit(checkIgnore(os.Args[2:]))
 
-		if err := os.MkdirAll(repoPath, 0750); err != nil {
-			fmt.Printf("Err: %v", err)
-			os.Exit(1)
+	case "write-tree":
+		// without an index, snapshot the whole working tree
+		if _, err := os.Stat(indexPath(".")); os.IsNotExist(err) {
+			matcher, err := newIgnoreMatcher(".")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading ignore files: %s\n", err)
+				os.Exit(1)
+			}
+			_, hash := writeTree(".", matcher)
+			fmt.Println(hash)
+			break
 		}
-
-		if err := initGitRepository(repoPath); err != nil {
-			fmt.Printf("Err: %v", err)
+		idx, err := readIndex(".")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading index: %s\n", err)
 			os.Exit(1)
 		}
-
-		commitSha, err := fetchLatestCommit(gitUrl)
+		hash, err := idx.writeTree()
 		if err != nil {
-			fmt.Printf("Err: %v", err)
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 			os.Exit(1)
 		}
-
-		if err := writeBranchRefFile(repoPath, "master", commitSha); err != nil {
-			fmt.Printf("Err: %v", err)
+		if err := idx.write("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing index: %s\n", err)
 			os.Exit(1)
 		}
+		fmt.Println(hash)
 
-		if err := fetchObjects(gitUrl, commitSha); err != nil {
-			fmt.Printf("Err: %v", err)
-			os.Exit(1)
-		}
+	case "commit-tree":
+		os.Exit(commitTree(os.Args[2:]))
 
-		if err := writeFetchedObjects(repoPath); err != nil {
-			fmt.Printf("Err: %v", err)
-			os.Exit(1)
-		}
+	case "commit":
+		os.Exit(commitIndex(os.Args[2:]))
 
-		if err := restoreRepository(repoPath, commitSha); err != nil {
-			fmt.Printf("Err: %v", err)
-			os.Exit(1)
-		}
+	case "clone":
+		os.Exit(clone(os.Args[2:]))
+
+	case "fetch":
+		os.Exit(fetch(os.Args[2:]))
+
+	case "push":
+		os.Exit(push(os.Args[2:]))
 
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command %s\n", command)
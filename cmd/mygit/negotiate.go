@@ -0,0 +1,214 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+)
+
+const (
+	// the first round of negotiation sends this many haves, and every
+	// later round twice as many as the one before, up to maxHaveWindow
+	initialHaveWindow = 16
+	maxHaveWindow     = 1024
+	// once the server has acknowledged a commit, negotiation stops after
+	// this many haves in a row that it did not acknowledge, as in git
+	maxHavesInVain = 256
+)
+
+type walkCommit struct {
+	sha     string
+	time    int64
+	parents []string
+}
+
+// historyQueue is a heap of commits, newest committer date first.
+type historyQueue []*walkCommit
+
+func (q historyQueue) Len() int           { return len(q) }
+func (q historyQueue) Less(i, j int) bool { return q[i].time > q[j].time }
+func (q historyQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *historyQueue) Push(x any) {
+	*q = append(*q, x.(*walkCommit))
+}
+
+func (q *historyQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// haveWalker lists the commits reachable from the local refs, newest
+// first, as the haves of a fetch. Commits known to be common with the
+// server are not listed, and neither are their ancestors.
+type haveWalker struct {
+	repoPath string
+	queue    historyQueue
+	commits  map[string]*walkCommit
+	common   map[string]bool
+	shallow  map[string]bool
+}
+
+// newHaveWalker starts a walk from HEAD and every ref under refs/.
+// shallow lists the commits whose parents are missing from the repository.
+func newHaveWalker(repoPath string, shallow []string) (*haveWalker, error) {
+	w := &haveWalker{
+		repoPath: repoPath,
+		commits:  make(map[string]*walkCommit),
+		common:   make(map[string]bool),
+		shallow:  make(map[string]bool),
+	}
+	for _, sha := range shallow {
+		w.shallow[sha] = true
+	}
+	refs, err := listRefs(repoPath, "refs/")
+	if err != nil {
+		return nil, err
+	}
+	tips := []string{}
+	if head, err := readRef(repoPath, "HEAD"); err == nil {
+		tips = append(tips, head)
+	}
+	for _, sha := range refs {
+		tips = append(tips, sha)
+	}
+	for _, sha := range tips {
+		// refs to trees and blobs have no history to offer
+		commitSha, err := peelToCommit(repoPath, sha)
+		if err != nil {
+			continue
+		}
+		if err := w.add(commitSha); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// add queues the commit sha unless it was seen before or is missing.
+func (w *haveWalker) add(sha string) error {
+	if _, ok := w.commits[sha]; ok {
+		return nil
+	}
+	commit, err := readCommit(w.repoPath, sha)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c := &walkCommit{sha: sha, time: commit.commitTime()}
+	if !w.shallow[sha] {
+		c.parents = commit.parents
+	}
+	w.commits[sha] = c
+	heap.Push(&w.queue, c)
+	return nil
+}
+
+// next returns the next commit to offer as a have, or "" when the
+// history is exhausted.
+func (w *haveWalker) next() (string, error) {
+	for w.queue.Len() > 0 {
+		c := heap.Pop(&w.queue).(*walkCommit)
+		if w.common[c.sha] {
+			continue
+		}
+		for _, parent := range c.parents {
+			if err := w.add(parent); err != nil {
+				return "", err
+			}
+		}
+		return c.sha, nil
+	}
+	return "", nil
+}
+
+// markCommon records that the server has sha and therefore all of its
+// ancestors.
+func (w *haveWalker) markCommon(sha string) {
+	pending := []string{sha}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if w.common[current] {
+			continue
+		}
+		w.common[current] = true
+		if c, ok := w.commits[current]; ok {
+			pending = append(pending, c.parents...)
+		}
+	}
+}
+
+// negotiatePack finds the commits the repository has in common with the
+// server by sending the local history as haves, in growing rounds, until
+// the server is ready to send the pack or the history runs out. It then
+// requests the pack, so that the server leaves out everything reachable
+// from the common commits.
+func negotiatePack(repoPath, gitUrl string, adv *RefAdvertisement, req *FetchRequest) (*http.Response, *FetchResponse, error) {
+	requestPack := requestPackV0
+	if adv.version == 2 {
+		requestPack = requestPackV2
+	}
+	walker, err := newHaveWalker(repoPath, req.shallow)
+	if err != nil {
+		return nil, nil, err
+	}
+	common := []string{}
+	window, inVain := initialHaveWindow, 0
+	for len(common) == 0 || inVain < maxHavesInVain {
+		batch := []string{}
+		for len(batch) < window {
+			sha, err := walker.next()
+			if err != nil {
+				return nil, nil, err
+			}
+			if sha == "" {
+				break
+			}
+			batch = append(batch, sha)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		// each HTTP request is stateless, so it repeats what the server
+		// acknowledged before
+		round := *req
+		round.haves = append(slices.Clone(common), batch...)
+		round.done = false
+		resp, fetched, err := requestPack(gitUrl, adv.capabilities, &round)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fetched.pack != nil {
+			// a v2 server sends the pack as soon as it is ready
+			return resp, fetched, nil
+		}
+		resp.Body.Close()
+
+		inVain += len(batch)
+		for _, ack := range fetched.acks {
+			if !slices.Contains(common, ack) {
+				common = append(common, ack)
+				walker.markCommon(ack)
+				inVain = 0
+			}
+		}
+		if fetched.ready {
+			break
+		}
+		if window < maxHaveWindow {
+			window *= 2
+		}
+	}
+
+	final := *req
+	final.haves = common
+	final.done = true
+	return requestPack(gitUrl, adv.capabilities, &final)
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PackEntry is a single entry of a packfile as recorded by the first pass
+// over the pack. Only the position of the compressed data is kept so that
+// objects can be inflated from the file when they are needed.
+type PackEntry struct {
+	offset     int64
+	dataOffset int64
+	objType    byte
+	size       int
+	baseOffset int64
+	baseSha    string
+	sha        string
+	crc        uint32
+}
+
+// Packfile is a packfile stored on disk together with the entries found
+// while indexing it, or with its .idx when it is read for lookups.
+type Packfile struct {
+	file        *os.File
+	checksum    []byte
+	objectCount int
+	// dataEnd is where the last entry ends and the checksum starts
+	dataEnd   int64
+	entries   []*PackEntry
+	index     *PackIndex
+	baseCache *deltaBaseCache
+}
+
+const deltaBaseCacheLimit = 32 << 20
+
+var openedPacks = make(map[string][]*Packfile)
+
+// deltaBaseCache keeps recently used delta bases of a pack so that objects
+// sharing a delta chain do not inflate the whole chain again. Entries are
+// evicted oldest first once the cached contents exceed limit bytes.
+type deltaBaseCache struct {
+	limit   int
+	size    int
+	order   []int64
+	objects map[int64]*Object
+}
+
+func newDeltaBaseCache(limit int) *deltaBaseCache {
+	return &deltaBaseCache{
+		limit:   limit,
+		objects: make(map[int64]*Object),
+	}
+}
+
+func (c *deltaBaseCache) get(offset int64) (*Object, bool) {
+	obj, ok := c.objects[offset]
+	return obj, ok
+}
+
+func (c *deltaBaseCache) add(offset int64, obj *Object) {
+	if _, ok := c.objects[offset]; ok || len(obj.Buf) > c.limit {
+		return
+	}
+	for c.size+len(obj.Buf) > c.limit && len(c.order) > 0 {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		c.size -= len(c.objects[oldest].Buf)
+		delete(c.objects, oldest)
+	}
+	c.objects[offset] = obj
+	c.order = append(c.order, offset)
+	c.size += len(obj.Buf)
+}
+
+// countingReader tracks how many bytes have been consumed from the pack
+// and hashes them for the trailing checksum and the per-entry CRC32. It
+// implements io.ByteReader so that zlib does not read past the end of each
+// compressed object.
+type countingReader struct {
+	reader *bufio.Reader
+	hash   hash.Hash
+	crc    hash.Hash32
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.hash.Write(p[:n])
+	c.crc.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	c.hash.Write([]byte{b})
+	c.crc.Write([]byte{b})
+	c.n++
+	return b, nil
+}
+
+// start of read object package
+func readObjectTypeAndLen(reader io.ByteReader) (byte, int, error) {
+	num := 0
+	b, err := reader.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	objType := (b & objMask) >> 4
+	num += int(b & firstRemMask)
+	if (b & msbMask) == 0 {
+		return objType, num, nil
+	}
+	i := 0
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		num += int(b&remMask) << (4 + 7*i)
+		if (b & msbMask) == 0 {
+			break
+		}
+		i++
+	}
+
+	return objType, num, nil
+}
+
+func readSha(reader io.Reader) (string, error) {
+	sha := make([]byte, 20)
+	if _, err := io.ReadFull(reader, sha); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha), nil
+}
+
+// readOfsDeltaOffset reads the negative base offset of an OFS_DELTA entry.
+// Each continuation byte implicitly adds one before shifting, so the
+// encoding has no redundant representations.
+func readOfsDeltaOffset(reader io.ByteReader) (int64, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	offset := int64(b & remMask)
+	for (b & msbMask) != 0 {
+		b, err = reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		offset = ((offset + 1) << 7) | int64(b&remMask)
+	}
+	return offset, nil
+}
+
+func decompressObject(reader io.Reader) (*bytes.Buffer, error) {
+	decompressedReader, err := zlib.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressedReader.Close()
+	decompressed := bytes.NewBuffer([]byte{})
+	if _, err := io.Copy(decompressed, decompressedReader); err != nil {
+		return nil, err
+	}
+	return decompressed, nil
+}
+
+func readDeltified(reader *bytes.Buffer, baseObj *Object) (*bytes.Buffer, error) {
+	_, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	dstObjLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	result := bytes.NewBuffer([]byte{})
+	for reader.Len() > 0 {
+		firstByte, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if (firstByte & msbMask) == 0 {
+			n := int64(firstByte & remMask)
+			if _, err := io.CopyN(result, reader, n); err != nil {
+				return nil, err
+			}
+		} else {
+			offset := 0
+			size := 0
+			for i := 0; i < 4; i++ {
+				if (firstByte>>i)&1 > 0 {
+					b, err := reader.ReadByte()
+					if err != nil {
+						return nil, err
+					}
+					offset += int(b) << (i * 8)
+				}
+			}
+
+			for i := 4; i < 7; i++ {
+				if (firstByte>>i)&1 > 0 {
+					b, err := reader.ReadByte()
+					if err != nil {
+						return nil, err
+					}
+					size += int(b) << ((i - 4) * 8)
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > len(baseObj.Buf) {
+				return nil, fmt.Errorf("invalid delta copy: offset %d size %d exceeds base length %d", offset, size, len(baseObj.Buf))
+			}
+
+			if _, err := result.Write(baseObj.Buf[offset : offset+size]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if result.Len() != int(dstObjLen) {
+		return nil, fmt.Errorf("invalid deltified buf: expected: %d, but got: %d", dstObjLen, result.Len())
+	}
+	return result, nil
+}
+
+func (o *Object) typeString() (string, error) {
+	switch o.Type {
+	case objCommit:
+		return "commit", nil
+	case objTree:
+		return "tree", nil
+	case objBlob:
+		return "blob", nil
+	case objTag:
+		return "tag", nil
+	default:
+		return "", fmt.Errorf("invalid type: %d", o.Type)
+	}
+}
+
+func wrapper(contents []byte, objectType string) (*bytes.Buffer, error) {
+	outerContents := bytes.NewBuffer([]byte{})
+	outerContents.WriteString(fmt.Sprintf("%s %d\x00", objectType, len(contents)))
+	if _, err := io.Copy(outerContents, bytes.NewReader(contents)); err != nil {
+		return nil, err
+	}
+	return outerContents, nil
+}
+
+func (o *Object) wrappedBuf() ([]byte, error) {
+	t, err := o.typeString()
+	if err != nil {
+		return []byte{}, err
+	}
+	wrappedBuf, err := wrapper(o.Buf, t)
+	if err != nil {
+		return []byte{}, err
+	}
+	return wrappedBuf.Bytes(), nil
+}
+
+func (o *Object) sha() (string, error) {
+	b, err := o.wrappedBuf()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha1.Sum(b)), nil
+}
+
+// readPackEntry reads the header of the pack entry at the current position
+// of reader and skips over its compressed data. Undeltified objects are
+// hashed while they are inflated; deltas are resolved in a second pass
+// since their base may appear later in the pack.
+func readPackEntry(reader *countingReader) (*PackEntry, error) {
+	entry := &PackEntry{offset: reader.n}
+	reader.crc.Reset()
+	objType, objLen, err := readObjectTypeAndLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	entry.objType = objType
+	entry.size = objLen
+	switch objType {
+	case objRefDelta:
+		if entry.baseSha, err = readSha(reader); err != nil {
+			return nil, err
+		}
+	case objOfsDelta:
+		negOffset, err := readOfsDeltaOffset(reader)
+		if err != nil {
+			return nil, err
+		}
+		entry.baseOffset = entry.offset - negOffset
+	case objCommit, objTree, objBlob, objTag:
+	default:
+		return nil, fmt.Errorf("unsupported object type %d at offset %d", objType, entry.offset)
+	}
+	entry.dataOffset = reader.n
+
+	decompressedReader, err := zlib.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressedReader.Close()
+	var dst io.Writer = io.Discard
+	objHash := sha1.New()
+	if objType != objRefDelta && objType != objOfsDelta {
+		obj := Object{Type: objType}
+		t, err := obj.typeString()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(objHash, "%s %d\x00", t, objLen)
+		dst = objHash
+	}
+	n, err := io.Copy(dst, decompressedReader)
+	if err != nil {
+		return nil, err
+	}
+	if int(n) != objLen {
+		return nil, fmt.Errorf("expect object length: %d, but get: %d", objLen, n)
+	}
+	if dst == objHash {
+		entry.sha = fmt.Sprintf("%x", objHash.Sum(nil))
+	}
+	entry.crc = reader.crc.Sum32()
+	return entry, nil
+}
+
+func openPackfile(packPath string) (*Packfile, error) {
+	f, err := os.Open(packPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Packfile{file: f}, nil
+}
+
+// openIndexedPackfile opens a pack stored in the repository together with
+// its .idx for object lookups.
+func openIndexedPackfile(packPath, idxPath string) (*Packfile, error) {
+	index, err := readPackIndex(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	p, err := openPackfile(packPath)
+	if err != nil {
+		return nil, err
+	}
+	p.index = index
+	p.objectCount = int(index.fanout[255])
+	p.baseCache = newDeltaBaseCache(deltaBaseCacheLimit)
+	return p, nil
+}
+
+func (p *Packfile) Close() error {
+	return p.file.Close()
+}
+
+// indexEntries is the first pass over the pack: it records the position
+// and base of every entry and verifies the trailing pack checksum.
+func (p *Packfile) indexEntries() error {
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := &countingReader{
+		reader: bufio.NewReader(p.file),
+		hash:   sha1.New(),
+		crc:    crc32.NewIEEE(),
+	}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if string(header[:4]) != "PACK" {
+		return errors.New("invalid packfile header")
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != 2 && version != 3 {
+		return fmt.Errorf("unsupported packfile version: %d", version)
+	}
+	p.objectCount = int(binary.BigEndian.Uint32(header[8:12]))
+
+	p.entries = make([]*PackEntry, 0, p.objectCount)
+	for i := 0; i < p.objectCount; i++ {
+		entry, err := readPackEntry(reader)
+		if err != nil {
+			return err
+		}
+		p.entries = append(p.entries, entry)
+	}
+
+	p.dataEnd = reader.n
+	calculatedChecksum := reader.hash.Sum(nil)
+	storedChecksum := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(reader.reader, storedChecksum); err != nil {
+		return err
+	}
+	if !bytes.Equal(storedChecksum, calculatedChecksum) {
+		return fmt.Errorf("pack checksum mismatch: expected %x, but got %x", storedChecksum, calculatedChecksum)
+	}
+	if _, err := reader.reader.ReadByte(); err != io.EOF {
+		return errors.New("garbage at end of packfile")
+	}
+	p.checksum = storedChecksum
+	return nil
+}
+
+// readEntryData inflates the data of entry from the pack, which is the
+// object contents or, for deltas, the delta instructions.
+func (p *Packfile) readEntryData(entry *PackEntry) ([]byte, error) {
+	section := io.NewSectionReader(p.file, entry.dataOffset, 1<<62)
+	decompressed, err := decompressObject(bufio.NewReader(section))
+	if err != nil {
+		return nil, err
+	}
+	return decompressed.Bytes(), nil
+}
+
+// resolveEntries is the second pass over the pack. Deltas are applied
+// depth first starting from the undeltified entries, so each delta is
+// resolved right after its base regardless of pack order and only the
+// current delta chain is held in memory. visit, when not nil, is called
+// once for every object in the pack. REF_DELTA bases missing from the pack,
+// as in a thin pack, are read with thinBase and appended to the pack; when
+// thinBase is nil they are an error.
+func (p *Packfile) resolveEntries(visit func(obj *Object) error, thinBase func(sha string) (*Object, error)) error {
+	ofsChildren := make(map[int64][]*PackEntry)
+	refChildren := make(map[string][]*PackEntry)
+	for _, entry := range p.entries {
+		switch entry.objType {
+		case objOfsDelta:
+			ofsChildren[entry.baseOffset] = append(ofsChildren[entry.baseOffset], entry)
+		case objRefDelta:
+			refChildren[entry.baseSha] = append(refChildren[entry.baseSha], entry)
+		}
+	}
+
+	resolved := 0
+	var resolve func(entry *PackEntry, obj *Object) error
+	resolve = func(entry *PackEntry, obj *Object) error {
+		if entry.sha == "" {
+			objSha, err := obj.sha()
+			if err != nil {
+				return err
+			}
+			entry.sha = objSha
+		}
+		if visit != nil {
+			if err := visit(obj); err != nil {
+				return err
+			}
+		}
+		resolved++
+		children := append([]*PackEntry{}, ofsChildren[entry.offset]...)
+		children = append(children, refChildren[entry.sha]...)
+		delete(refChildren, entry.sha)
+		for _, child := range children {
+			delta, err := p.readEntryData(child)
+			if err != nil {
+				return err
+			}
+			deltified, err := readDeltified(bytes.NewBuffer(delta), obj)
+			if err != nil {
+				return err
+			}
+			if err := resolve(child, &Object{Type: obj.Type, Buf: deltified.Bytes()}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, entry := range p.entries {
+		if entry.objType == objOfsDelta || entry.objType == objRefDelta {
+			continue
+		}
+		data, err := p.readEntryData(entry)
+		if err != nil {
+			return err
+		}
+		if err := resolve(entry, &Object{Type: entry.objType, Buf: data}); err != nil {
+			return err
+		}
+	}
+	if thinBase != nil {
+		bases := make([]string, 0, len(refChildren))
+		for baseSha := range refChildren {
+			bases = append(bases, baseSha)
+		}
+		sort.Strings(bases)
+		for _, baseSha := range bases {
+			// resolving an earlier base may have resolved this one too
+			if _, ok := refChildren[baseSha]; !ok {
+				continue
+			}
+			obj, err := thinBase(baseSha)
+			if err != nil {
+				return err
+			}
+			entry, err := p.appendObject(obj)
+			if err != nil {
+				return err
+			}
+			if err := resolve(entry, obj); err != nil {
+				return err
+			}
+		}
+	}
+	if resolved != len(p.entries) {
+		for baseSha := range refChildren {
+			return fmt.Errorf("unknown obj sha: %s", baseSha)
+		}
+		return fmt.Errorf("unresolved deltas: %d of %d objects resolved", resolved, len(p.entries))
+	}
+	return nil
+}
+
+// readObjectAt inflates the object whose entry starts at offset, applying
+// its delta chain when the entry is deltified. REF_DELTA bases are looked
+// up through the pack index.
+func (p *Packfile) readObjectAt(offset int64) (*Object, error) {
+	if obj, ok := p.baseCache.get(offset); ok {
+		return obj, nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(p.file, offset, 1<<62))
+	objType, objLen, err := readObjectTypeAndLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	baseOffset := int64(-1)
+	switch objType {
+	case objRefDelta:
+		baseSha, err := readSha(reader)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if baseOffset, ok = p.index.findOffset(baseSha); !ok {
+			return nil, fmt.Errorf("unknown obj sha: %s", baseSha)
+		}
+	case objOfsDelta:
+		negOffset, err := readOfsDeltaOffset(reader)
+		if err != nil {
+			return nil, err
+		}
+		baseOffset = offset - negOffset
+	case objCommit, objTree, objBlob, objTag:
+	default:
+		return nil, fmt.Errorf("unsupported object type %d at offset %d", objType, offset)
+	}
+	decompressed, err := decompressObject(reader)
+	if err != nil {
+		return nil, err
+	}
+	if objLen != decompressed.Len() {
+		return nil, fmt.Errorf("expect object length: %d, but get: %d", objLen, decompressed.Len())
+	}
+	if baseOffset < 0 {
+		return &Object{Type: objType, Buf: decompressed.Bytes()}, nil
+	}
+
+	baseObj, err := p.readObjectAt(baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	p.baseCache.add(baseOffset, baseObj)
+	deltified, err := readDeltified(decompressed, baseObj)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{Type: baseObj.Type, Buf: deltified.Bytes()}, nil
+}
+
+// repositoryPacks returns the packs under .git/objects/pack of repoPath.
+// They are opened once and kept open for the lifetime of the process.
+func repositoryPacks(repoPath string) ([]*Packfile, error) {
+	if packs, ok := openedPacks[repoPath]; ok {
+		return packs, nil
+	}
+	idxPaths, err := filepath.Glob(path.Join(repoPath, ".git", "objects", "pack", "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	packs := []*Packfile{}
+	for _, idxPath := range idxPaths {
+		packPath := strings.TrimSuffix(idxPath, ".idx") + ".pack"
+		p, err := openIndexedPackfile(packPath, idxPath)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, p)
+	}
+	openedPacks[repoPath] = packs
+	return packs, nil
+}
+
+// readPackedObject looks objectSha up in every pack of the repository. It
+// returns an error wrapping os.ErrNotExist when no pack contains it.
+func readPackedObject(repoPath, objectSha string) (*Object, error) {
+	packs, err := repositoryPacks(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packs {
+		if offset, ok := p.index.findOffset(objectSha); ok {
+			return p.readObjectAt(offset)
+		}
+	}
+	return nil, fmt.Errorf("object %s: %w", objectSha, os.ErrNotExist)
+}
+
+// hasObject reports whether the object named sha is stored in the
+// repository, either loose or in a pack.
+func hasObject(repoPath, sha string) bool {
+	if !isObjectSha(sha) {
+		return false
+	}
+	if _, err := os.Stat(path.Join(repoPath, ".git", "objects", sha[:2], sha[2:])); err == nil {
+		return true
+	}
+	packs, err := repositoryPacks(repoPath)
+	if err != nil {
+		return false
+	}
+	for _, p := range packs {
+		if _, ok := p.index.findOffset(sha); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// end of read object package
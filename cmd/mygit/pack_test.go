@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// packBuilder writes a pack entry by entry so that tests control the
+// order of entries and how they are deltified.
+type packBuilder struct {
+	buf   bytes.Buffer
+	count int
+}
+
+func newPackBuilder() *packBuilder {
+	b := &packBuilder{}
+	b.buf.WriteString("PACK")
+	binary.Write(&b.buf, binary.BigEndian, []uint32{2, 0})
+	return b
+}
+
+// add writes an entry with the given header fields followed by extra, the
+// base reference of a delta, and the compressed data. It returns the
+// offset of the entry.
+func (b *packBuilder) add(t *testing.T, objType byte, extra, data []byte) int64 {
+	t.Helper()
+	offset := int64(b.buf.Len())
+	if err := writePackEntryHeader(&b.buf, objType, len(data)); err != nil {
+		t.Fatal(err)
+	}
+	b.buf.Write(extra)
+	zw := zlib.NewWriter(&b.buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b.count++
+	return offset
+}
+
+func (b *packBuilder) whole(t *testing.T, objType byte, data []byte) int64 {
+	return b.add(t, objType, nil, data)
+}
+
+// ofsDelta adds a delta against the entry at base, whose distance is
+// written the way readOfsDeltaOffset reads it.
+func (b *packBuilder) ofsDelta(t *testing.T, base int64, delta []byte) int64 {
+	distance := int64(b.buf.Len()) - base
+	encoded := []byte{byte(distance & 0x7f)}
+	for distance >>= 7; distance > 0; distance >>= 7 {
+		distance--
+		encoded = append([]byte{byte(distance&0x7f) | 0x80}, encoded...)
+	}
+	return b.add(t, objOfsDelta, encoded, delta)
+}
+
+func (b *packBuilder) refDelta(t *testing.T, baseSha string, delta []byte) int64 {
+	name, err := hex.DecodeString(baseSha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.add(t, objRefDelta, name, delta)
+}
+
+// pack returns the pack with its object count and checksum filled in.
+func (b *packBuilder) pack() []byte {
+	pack := append([]byte{}, b.buf.Bytes()...)
+	binary.BigEndian.PutUint32(pack[8:12], uint32(b.count))
+	checksum := sha1.Sum(pack)
+	return append(pack, checksum[:]...)
+}
+
+// write saves the pack in dir and returns its path.
+func (b *packBuilder) write(t *testing.T, dir string) string {
+	t.Helper()
+	packPath := filepath.Join(dir, "test.pack")
+	if err := os.WriteFile(packPath, b.pack(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return packPath
+}
+
+// appendDelta returns a delta that copies all of base and appends suffix.
+func appendDelta(base, suffix []byte) []byte {
+	varint := func(n int) []byte {
+		out := []byte{}
+		for n >= 0x80 {
+			out = append(out, byte(n)|0x80)
+			n >>= 7
+		}
+		return append(out, byte(n))
+	}
+	delta := append(varint(len(base)), varint(len(base)+len(suffix))...)
+	// copy with a two byte offset (zero, left out) and a two byte size
+	delta = append(delta, 0x80|0x10|0x20, byte(len(base)), byte(len(base)>>8))
+	for len(suffix) > 0 {
+		n := min(len(suffix), 0x7f)
+		delta = append(delta, byte(n))
+		delta = append(delta, suffix[:n]...)
+		suffix = suffix[n:]
+	}
+	return delta
+}
+
+func blobSha(t *testing.T, contents string) string {
+	t.Helper()
+	sha, err := (&Object{Type: objBlob, Buf: []byte(contents)}).sha()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+// resolvePack indexes and resolves the pack at packPath and returns the
+// contents of its objects by id.
+func resolvePack(t *testing.T, packPath string, thinBase func(sha string) (*Object, error)) (map[string]string, error) {
+	t.Helper()
+	packfile, err := openPackfile(packPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packfile.Close()
+	if err := packfile.indexEntries(); err != nil {
+		t.Fatal(err)
+	}
+	objects := make(map[string]string)
+	err = packfile.resolveEntries(func(obj *Object) error {
+		sha, err := obj.sha()
+		objects[sha] = string(obj.Buf)
+		return err
+	}, thinBase)
+	return objects, err
+}
+
+func checkObjects(t *testing.T, got map[string]string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("got %d objects, want %d", len(got), len(want))
+	}
+	for _, contents := range want {
+		sha := blobSha(t, contents)
+		if got[sha] != contents {
+			t.Errorf("object %s is %q, want %q", sha, got[sha], contents)
+		}
+	}
+}
+
+func TestResolveOfsDeltaChain(t *testing.T) {
+	base := strings.Repeat("line of the base blob\n", 20)
+	first := base + "first change\n"
+	second := first + "second change\n"
+
+	b := newPackBuilder()
+	baseOffset := b.whole(t, objBlob, []byte(base))
+	firstOffset := b.ofsDelta(t, baseOffset, appendDelta([]byte(base), []byte("first change\n")))
+	b.ofsDelta(t, firstOffset, appendDelta([]byte(first), []byte("second change\n")))
+	packPath := b.write(t, t.TempDir())
+
+	objects, err := resolvePack(t, packPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkObjects(t, objects, base, first, second)
+}
+
+func TestResolveRefDeltaBeforeBase(t *testing.T) {
+	base := strings.Repeat("line of the base blob\n", 20)
+	changed := base + "change\n"
+
+	b := newPackBuilder()
+	b.refDelta(t, blobSha(t, base), appendDelta([]byte(base), []byte("change\n")))
+	b.whole(t, objBlob, []byte(base))
+	packPath := b.write(t, t.TempDir())
+
+	objects, err := resolvePack(t, packPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkObjects(t, objects, base, changed)
+}
+
+func TestResolveMissingRefDeltaBase(t *testing.T) {
+	base := strings.Repeat("line of the base blob\n", 20)
+
+	b := newPackBuilder()
+	b.refDelta(t, blobSha(t, base), appendDelta([]byte(base), []byte("change\n")))
+	packPath := b.write(t, t.TempDir())
+
+	_, err := resolvePack(t, packPath, nil)
+	if err == nil || !strings.Contains(err.Error(), "unknown obj sha: "+blobSha(t, base)) {
+		t.Errorf("got error %v for a pack missing a delta base", err)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// objectWalk collects the objects reachable from some tips that are not
+// reachable from a set of excluded objects, like git rev-list --objects.
+type objectWalk struct {
+	repoPath string
+	excluded map[string]bool
+	seen     map[string]bool
+	objects  []string
+}
+
+// excludeCommits marks the commits reachable from sha as excluded. Commits
+// missing from the repository end the walk.
+func (w *objectWalk) excludeCommits(sha string) error {
+	pending := []string{sha}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if w.excluded[current] || !hasObject(w.repoPath, current) {
+			continue
+		}
+		w.excluded[current] = true
+		commit, err := readCommit(w.repoPath, current)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, commit.parents...)
+	}
+	return nil
+}
+
+// excludeTree marks the tree sha and everything it contains as excluded.
+func (w *objectWalk) excludeTree(sha string) error {
+	if w.excluded[sha] {
+		return nil
+	}
+	w.excluded[sha] = true
+	contents, err := readObjectContent(w.repoPath, sha)
+	if err != nil {
+		return err
+	}
+	tree, err := parseTree(contents)
+	if err != nil {
+		return err
+	}
+	for _, child := range tree.children {
+		switch treeEntryType(child.mode) {
+		case "tree":
+			if err := w.excludeTree(child.sha); err != nil {
+				return err
+			}
+		case "blob":
+			w.excluded[child.sha] = true
+		}
+	}
+	return nil
+}
+
+// add records sha as an object to send unless it is excluded or was
+// added before, and reports whether it was added.
+func (w *objectWalk) add(sha string) bool {
+	if w.excluded[sha] || w.seen[sha] {
+		return false
+	}
+	w.seen[sha] = true
+	w.objects = append(w.objects, sha)
+	return true
+}
+
+// addTree adds the tree sha and the trees and blobs it contains.
+// Submodule commits are not part of the repository and are left out.
+func (w *objectWalk) addTree(sha string) error {
+	if !w.add(sha) {
+		return nil
+	}
+	contents, err := readObjectContent(w.repoPath, sha)
+	if err != nil {
+		return err
+	}
+	tree, err := parseTree(contents)
+	if err != nil {
+		return err
+	}
+	for _, child := range tree.children {
+		switch treeEntryType(child.mode) {
+		case "tree":
+			if err := w.addTree(child.sha); err != nil {
+				return err
+			}
+		case "blob":
+			w.add(child.sha)
+		}
+	}
+	return nil
+}
+
+// addTip adds the object sha with everything reachable from it: the
+// objects tags point to and the history of commits.
+func (w *objectWalk) addTip(sha string) error {
+	for {
+		objReader, err := NewGitObjectReader(w.repoPath, sha)
+		if err != nil {
+			return err
+		}
+		var contents []byte
+		if objReader.Type == "tag" {
+			contents, err = objReader.ReadContents()
+		}
+		objReader.Close()
+		if err != nil {
+			return err
+		}
+		switch objReader.Type {
+		case "blob":
+			w.add(sha)
+			return nil
+		case "tree":
+			return w.addTree(sha)
+		case "commit":
+			return w.addCommits(sha)
+		}
+		if !w.add(sha) {
+			return nil
+		}
+		firstLine, _, _ := bytes.Cut(contents, []byte("\n"))
+		next, ok := strings.CutPrefix(string(firstLine), "object ")
+		if !ok || !isObjectSha(next) {
+			return fmt.Errorf("invalid tag object %s", sha)
+		}
+		sha = next
+	}
+}
+
+// addCommits adds the commits reachable from sha with their trees. The
+// trees of the excluded parents where the walk stops are excluded first,
+// so that files the commits share with them are left out.
+func (w *objectWalk) addCommits(sha string) error {
+	commits := []*Commit{}
+	pending := []string{sha}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if !w.add(current) {
+			continue
+		}
+		commit, err := readCommit(w.repoPath, current)
+		if err != nil {
+			return err
+		}
+		commits = append(commits, commit)
+		for _, parent := range commit.parents {
+			if !w.excluded[parent] {
+				// parents missing from a shallow repository are not sent
+				if hasObject(w.repoPath, parent) {
+					pending = append(pending, parent)
+				}
+				continue
+			}
+			boundary, err := readCommit(w.repoPath, parent)
+			if err != nil {
+				return err
+			}
+			if err := w.excludeTree(boundary.tree); err != nil {
+				return err
+			}
+		}
+	}
+	for _, commit := range commits {
+		if err := w.addTree(commit.tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listMissingObjects returns the objects reachable from tips that are not
+// reachable from exclude, the objects a remote whose refs point to exclude
+// lacks. Excluded objects missing from the repository are ignored.
+func listMissingObjects(repoPath string, tips, exclude []string) ([]string, error) {
+	w := &objectWalk{
+		repoPath: repoPath,
+		excluded: make(map[string]bool),
+		seen:     make(map[string]bool),
+	}
+	for _, sha := range exclude {
+		if !hasObject(repoPath, sha) {
+			continue
+		}
+		commitSha, err := peelToCommit(repoPath, sha)
+		if err != nil {
+			// a tag of a tree or blob has no history to exclude
+			w.excluded[sha] = true
+			continue
+		}
+		w.excluded[sha] = true
+		if err := w.excludeCommits(commitSha); err != nil {
+			return nil, err
+		}
+		commit, err := readCommit(repoPath, commitSha)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.excludeTree(commit.tree); err != nil {
+			return nil, err
+		}
+	}
+	for _, sha := range tips {
+		if err := w.addTip(sha); err != nil {
+			return nil, err
+		}
+	}
+	return w.objects, nil
+}
+
+// writePack writes a version 2 pack of the objects shas to out. Objects
+// are stored whole, without deltas, and the pack ends with its SHA-1.
+func writePack(out io.Writer, repoPath string, shas []string) error {
+	packHash := sha1.New()
+	w := bufio.NewWriter(io.MultiWriter(out, packHash))
+	if _, err := w.Write([]byte("PACK")); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, []uint32{2, uint32(len(shas))}); err != nil {
+		return err
+	}
+	for _, sha := range shas {
+		objReader, err := NewGitObjectReader(repoPath, sha)
+		if err != nil {
+			return err
+		}
+		contents, err := objReader.ReadContents()
+		objReader.Close()
+		if err != nil {
+			return err
+		}
+		objType, ok := objectTypeCodes[objReader.Type]
+		if !ok {
+			return fmt.Errorf("object %s has unknown type %s", sha, objReader.Type)
+		}
+		if err := writePackEntryHeader(w, objType, len(contents)); err != nil {
+			return err
+		}
+		zw := zlib.NewWriter(w)
+		if _, err := zw.Write(contents); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := out.Write(packHash.Sum(nil))
+	return err
+}
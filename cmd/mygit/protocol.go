@@ -0,0 +1,804 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// userAgent identifies the client in the agent capability.
+const userAgent = "mygit/1.0"
+
+// Packets without a payload. The delimiter and response end packets only
+// occur in protocol v2.
+const (
+	flushPacket       = "0000"
+	delimPacket       = "0001"
+	responseEndPacket = "0002"
+)
+
+// readPacket reads one pkt-line. For the special packets it returns a nil
+// payload and the packet itself, such as flushPacket, as kind.
+func readPacket(reader io.Reader) (payload []byte, kind string, err error) {
+	hex := make([]byte, 4)
+	if _, err := io.ReadFull(reader, hex); err != nil {
+		return nil, "", err
+	}
+	switch string(hex) {
+	case flushPacket, delimPacket, responseEndPacket:
+		return nil, string(hex), nil
+	}
+
+	size, err := strconv.ParseUint(string(hex), 16, 16)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid pkt-line length %q", hex)
+	}
+	if size < 4 {
+		return nil, "", fmt.Errorf("invalid pkt-line length %d", size)
+	}
+
+	buf := make([]byte, size-4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, "", err
+	}
+	return buf, "", nil
+}
+
+// readPacketLine reads one pkt-line, returning an empty line for a flush
+// packet.
+func readPacketLine(reader io.Reader) ([]byte, error) {
+	line, kind, err := readPacket(reader)
+	if err != nil {
+		return []byte{}, err
+	}
+	if kind != "" && kind != flushPacket {
+		return []byte{}, fmt.Errorf("unexpected special packet %s", kind)
+	}
+	if line == nil {
+		return []byte{}, nil
+	}
+	return line, nil
+}
+
+func packetLine(rawLine string) string {
+	size := len(rawLine) + 4
+	return fmt.Sprintf("%04x%s", size, rawLine)
+}
+
+// Side-band channels multiplexed in a side-band or side-band-64k response.
+const (
+	sideBandData     = 1
+	sideBandProgress = 2
+	sideBandError    = 3
+)
+
+// sideBandReader reads the pack data sent on band 1 of a side-band
+// response. Progress messages from band 2 are copied to progress, and a
+// message on band 3 aborts the read with an error.
+type sideBandReader struct {
+	reader   *bufio.Reader
+	progress io.Writer
+	midLine  bool
+	pending  []byte
+	err      error
+}
+
+func (r *sideBandReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		line, err := readPacketLine(r.reader)
+		if err != nil {
+			return 0, err
+		}
+		if len(line) == 0 {
+			r.err = io.EOF
+			continue
+		}
+		switch line[0] {
+		case sideBandData:
+			r.pending = line[1:]
+		case sideBandProgress:
+			if r.progress != nil {
+				r.midLine = writeRemoteMessage(r.progress, line[1:], r.midLine)
+			}
+		case sideBandError:
+			r.err = fmt.Errorf("remote error: %s", strings.TrimSpace(string(line[1:])))
+		default:
+			r.err = fmt.Errorf("invalid side-band channel %d", line[0])
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// writeRemoteMessage shows a progress message from the server, prefixing
+// every line with "remote: " the way git does. Messages end their lines
+// with "\r" to redraw a progress meter in place, and a line may be split
+// across messages: midLine tells whether the previous message ended in the
+// middle of a line, and the result whether this one does.
+func writeRemoteMessage(w io.Writer, msg []byte, midLine bool) bool {
+	for len(msg) > 0 {
+		end := bytes.IndexAny(msg, "\r\n")
+		if end < 0 {
+			end = len(msg) - 1
+		}
+		if !midLine {
+			fmt.Fprint(w, "remote: ")
+		}
+		fmt.Fprintf(w, "%s", msg[:end+1])
+		midLine = msg[end] != '\r' && msg[end] != '\n'
+		msg = msg[end+1:]
+	}
+	return midLine
+}
+
+// readAcknowledgments reads the server's answer to the haves: ACK lines
+// for common commits, ending with a NAK or an ACK without a status, which
+// precede the pack. It returns the acknowledged commits and whether the
+// server sent "ACK <oid> ready", meaning it has found enough common
+// commits to send the pack.
+func readAcknowledgments(reader *bufio.Reader) (acked []string, ready bool, err error) {
+	for {
+		line, err := readPacketLine(reader)
+		if err != nil {
+			return nil, false, err
+		}
+		fields := strings.Fields(string(line))
+		switch {
+		case len(fields) == 0:
+			return nil, false, fmt.Errorf("unexpected flush while waiting for ACK or NAK")
+		case fields[0] == "NAK":
+			return acked, ready, nil
+		case fields[0] == "ERR":
+			return nil, false, fmt.Errorf("remote error: %s", strings.TrimSpace(strings.TrimPrefix(string(line), "ERR")))
+		case fields[0] == "ACK" && len(fields) >= 2 && isObjectSha(fields[1]):
+			acked = append(acked, fields[1])
+			// "continue", "common" and "ready" are followed by more lines
+			if len(fields) == 2 {
+				return acked, ready, nil
+			}
+			ready = ready || fields[2] == "ready"
+		default:
+			return nil, false, fmt.Errorf("expected ACK or NAK, got %q", line)
+		}
+	}
+}
+
+// Capabilities are the features a server announces after the first ref
+// it advertises, such as "ofs-delta" or "symref=HEAD:refs/heads/main".
+// Capabilities like symref may be announced several times.
+type Capabilities struct {
+	values map[string][]string
+}
+
+func parseCapabilities(line string) Capabilities {
+	c := Capabilities{values: make(map[string][]string)}
+	for _, field := range strings.Fields(line) {
+		name, value, _ := strings.Cut(field, "=")
+		c.values[name] = append(c.values[name], value)
+	}
+	return c
+}
+
+func (c Capabilities) has(name string) bool {
+	_, ok := c.values[name]
+	return ok
+}
+
+// value returns the value of the capability name, such as the version
+// in "agent=git/2.43.0", or "" when it has none.
+func (c Capabilities) value(name string) string {
+	if values := c.values[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// negotiateCapabilities returns the capabilities the client sends with its
+// first want: those of wanted that the server supports, in order. The
+// agent capability is answered with the client's own agent string. It
+// fails when the server lacks one of required.
+func negotiateCapabilities(server Capabilities, wanted, required []string) ([]string, error) {
+	for _, name := range required {
+		if !server.has(name) {
+			return nil, fmt.Errorf("server does not support the %s capability", name)
+		}
+	}
+	selected := []string{}
+	for _, name := range wanted {
+		if !server.has(name) {
+			continue
+		}
+		if name == "agent" {
+			selected = append(selected, "agent="+userAgent)
+			continue
+		}
+		selected = append(selected, name)
+	}
+	return selected, nil
+}
+
+// RemoteRef is a ref advertised by the server. peeled holds the object an
+// annotated tag points to, when the server advertised it.
+type RemoteRef struct {
+	name   string
+	sha    string
+	peeled string
+}
+
+// RefAdvertisement lists the refs a server offers, in order, with the
+// targets of its symbolic refs, such as refs/heads/main for HEAD. version
+// is the protocol version the server speaks, 0 or 2; capabilities are
+// those sent with the first ref in v0 and the capability advertisement in
+// v2.
+type RefAdvertisement struct {
+	version      int
+	refs         []RemoteRef
+	symrefs      map[string]string
+	capabilities Capabilities
+}
+
+// find returns the advertised ref called name, or nil.
+func (adv *RefAdvertisement) find(name string) *RemoteRef {
+	for i := range adv.refs {
+		if adv.refs[i].name == name {
+			return &adv.refs[i]
+		}
+	}
+	return nil
+}
+
+// symref returns the target of the symbolic ref name, or "" when the
+// server did not announce one.
+func (adv *RefAdvertisement) symref(name string) string {
+	return adv.symrefs[name]
+}
+
+// parseRefAdvertisement reads the v0 ref lines that follow first up to
+// the flush packet. An empty repository advertises only its capabilities,
+// on a line for the pseudo ref "capabilities^{}".
+func parseRefAdvertisement(reader *bufio.Reader, first []byte) (*RefAdvertisement, error) {
+	adv := &RefAdvertisement{capabilities: parseCapabilities(""), symrefs: make(map[string]string)}
+	line := first
+	for isFirst := true; len(line) > 0; isFirst = false {
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if isFirst {
+			var capabilities []byte
+			line, capabilities, _ = bytes.Cut(line, []byte{0})
+			adv.capabilities = parseCapabilities(string(capabilities))
+			for _, value := range adv.capabilities.values["symref"] {
+				if source, target, ok := strings.Cut(value, ":"); ok {
+					adv.symrefs[source] = target
+				}
+			}
+		}
+		sha, name, ok := strings.Cut(string(line), " ")
+		if !ok || !isObjectSha(sha) {
+			return nil, fmt.Errorf("invalid ref advertisement line: %q", line)
+		}
+		switch {
+		case isFirst && name == "capabilities^{}":
+		case strings.HasSuffix(name, "^{}"):
+			tagName := strings.TrimSuffix(name, "^{}")
+			if len(adv.refs) == 0 || adv.refs[len(adv.refs)-1].name != tagName {
+				return nil, fmt.Errorf("peeled ref %s does not follow its tag", name)
+			}
+			adv.refs[len(adv.refs)-1].peeled = sha
+		default:
+			adv.refs = append(adv.refs, RemoteRef{name: name, sha: sha})
+		}
+
+		var err error
+		if line, err = readPacketLine(reader); err != nil {
+			return nil, err
+		}
+	}
+	return adv, nil
+}
+
+// readCapabilitiesV2 reads the v2 capability advertisement that follows
+// the "version 2" line, one capability per pkt-line.
+func readCapabilitiesV2(reader *bufio.Reader) (Capabilities, error) {
+	capabilities := parseCapabilities("")
+	for {
+		line, err := readPacketLine(reader)
+		if err != nil {
+			return capabilities, err
+		}
+		if len(line) == 0 {
+			return capabilities, nil
+		}
+		name, value, _ := strings.Cut(strings.TrimSuffix(string(line), "\n"), "=")
+		capabilities.values[name] = append(capabilities.values[name], value)
+	}
+}
+
+// postService sends a request to service, git-upload-pack or
+// git-receive-pack, of the server at gitUrl, asking for protocol v2 when
+// version is 2.
+func postService(gitUrl, service string, version int, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, gitUrl+"/"+service, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-"+service+"-request")
+	req.Header.Set("Accept", "application/x-"+service+"-result")
+	if version == 2 {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s request: %w", service, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s request: unexpected status %s", service, resp.Status)
+	}
+	return resp, nil
+}
+
+// commandV2 encodes a protocol v2 request for command with its arguments,
+// announcing the client's agent and object format when the server
+// advertises them.
+func commandV2(server Capabilities, command string, args []string) *bytes.Buffer {
+	buf := bytes.NewBuffer([]byte{})
+	buf.WriteString(packetLine("command=" + command + "\n"))
+	if server.has("agent") {
+		buf.WriteString(packetLine("agent=" + userAgent + "\n"))
+	}
+	if server.has("object-format") {
+		buf.WriteString(packetLine("object-format=sha1\n"))
+	}
+	buf.WriteString(delimPacket)
+	for _, arg := range args {
+		buf.WriteString(packetLine(arg + "\n"))
+	}
+	buf.WriteString(flushPacket)
+	return buf
+}
+
+// listRefsV2 runs the v2 ls-refs command, asking only for the refs that
+// start with one of prefixes.
+func listRefsV2(gitUrl string, server Capabilities, prefixes []string) (*RefAdvertisement, error) {
+	args := []string{"peel", "symrefs"}
+	if slices.Contains(strings.Fields(server.value("ls-refs")), "unborn") {
+		args = append(args, "unborn")
+	}
+	for _, prefix := range prefixes {
+		args = append(args, "ref-prefix "+prefix)
+	}
+	resp, err := postService(gitUrl, "git-upload-pack", 2, commandV2(server, "ls-refs", args))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	adv := &RefAdvertisement{version: 2, capabilities: server, symrefs: make(map[string]string)}
+	for {
+		line, err := readPacketLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			return adv, nil
+		}
+		// "<oid> <name> [symref-target:<target>] [peeled:<oid>]", or
+		// "unborn <name> ..." for a symbolic ref to a branch without commits
+		fields := strings.Fields(string(line))
+		if len(fields) < 2 || (fields[0] != "unborn" && !isObjectSha(fields[0])) {
+			return nil, fmt.Errorf("invalid ls-refs line: %q", line)
+		}
+		ref := RemoteRef{name: fields[1], sha: fields[0]}
+		for _, attribute := range fields[2:] {
+			if target, ok := strings.CutPrefix(attribute, "symref-target:"); ok {
+				adv.symrefs[ref.name] = target
+			} else if peeled, ok := strings.CutPrefix(attribute, "peeled:"); ok {
+				ref.peeled = peeled
+			}
+		}
+		if ref.sha != "unborn" {
+			adv.refs = append(adv.refs, ref)
+		}
+	}
+}
+
+// getInfoRefs starts the discovery of the refs service, git-upload-pack
+// or git-receive-pack, offers at gitUrl, asking for protocol v2 when
+// version is 2. It returns the response, a reader positioned after the
+// first line of the advertisement and that line.
+func getInfoRefs(gitUrl, service string, version int) (*http.Response, *bufio.Reader, []byte, error) {
+	url := fmt.Sprintf("%s/info/refs?service=%s", gitUrl, service)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if version == 2 {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, nil, nil, fmt.Errorf("%s: unexpected status %s", url, res.Status)
+	}
+	reader := bufio.NewReader(res.Body)
+
+	// v0 starts with the service name and a flush packet, which some
+	// servers also send before the v2 capabilities
+	line, err := readPacketLine(reader)
+	if err == nil && string(bytes.TrimSuffix(line, []byte("\n"))) == "# service="+service {
+		if _, err = readPacketLine(reader); err == nil {
+			line, err = readPacketLine(reader)
+		}
+	}
+	if err != nil {
+		res.Body.Close()
+		return nil, nil, nil, fmt.Errorf("%s: not a smart git server: %w", gitUrl, err)
+	}
+	return res, reader, line, nil
+}
+
+// fetchRefAdvertisement asks the server at gitUrl for the refs it offers
+// to git-upload-pack. It asks for protocol v2, where only the refs
+// starting with one of prefixes are listed, and falls back to v0 when the
+// server answers with a v0 advertisement.
+func fetchRefAdvertisement(gitUrl string, prefixes []string) (*RefAdvertisement, error) {
+	res, reader, line, err := getInfoRefs(gitUrl, "git-upload-pack", 2)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch string(bytes.TrimSuffix(line, []byte("\n"))) {
+	case "version 2":
+		capabilities, err := readCapabilitiesV2(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !capabilities.has("ls-refs") || !capabilities.has("fetch") {
+			return nil, fmt.Errorf("%s: server does not support the ls-refs and fetch commands", gitUrl)
+		}
+		return listRefsV2(gitUrl, capabilities, prefixes)
+	case "version 1":
+		if line, err = readPacketLine(reader); err != nil {
+			return nil, err
+		}
+	}
+	return parseRefAdvertisement(reader, line)
+}
+
+// FetchRequest describes what to ask git-upload-pack for. haves are
+// commits the client already has, and shallow those it has without their
+// parents. Unless done is set the request is one round of negotiation,
+// answered with acknowledgments only. depth limits the history to that
+// many commits when positive, and filter is a partial clone filter spec
+// such as "blob:none". includeTags asks for the annotated tags pointing
+// into the pack. The server's progress messages are written to progress,
+// or not requested when it is nil.
+type FetchRequest struct {
+	wants       []string
+	haves       []string
+	shallow     []string
+	done        bool
+	depth       int
+	filter      string
+	includeTags bool
+	progress    io.Writer
+}
+
+// capabilities returns the capabilities to request for req from a v0
+// server announcing server.
+func (req *FetchRequest) capabilities(server Capabilities) ([]string, error) {
+	wanted := []string{"multi_ack_detailed", "side-band-64k", "thin-pack", "ofs-delta", "agent"}
+	if !server.has("side-band-64k") {
+		wanted = append(wanted, "side-band")
+	}
+	if req.progress == nil {
+		wanted = append(wanted, "no-progress")
+	}
+	if req.includeTags {
+		wanted = append(wanted, "include-tag")
+	}
+	required := []string{}
+	if req.depth > 0 || len(req.shallow) > 0 {
+		wanted = append(wanted, "shallow")
+		required = append(required, "shallow")
+	}
+	if req.filter != "" {
+		wanted = append(wanted, "filter")
+		required = append(required, "filter")
+	}
+	return negotiateCapabilities(server, wanted, required)
+}
+
+// readShallow returns the commits listed in .git/shallow, whose parents
+// are missing from a shallow repository.
+func readShallow(repoPath string) ([]string, error) {
+	contents, err := os.ReadFile(path.Join(repoPath, ".git", "shallow"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(contents)), nil
+}
+
+// writeShallow adds the commits whose parents were left out of a shallow
+// fetch to .git/shallow and removes those whose parents were fetched,
+// keeping the file sorted and without duplicates.
+func writeShallow(repoPath string, shallow, unshallow []string) error {
+	if len(shallow) == 0 && len(unshallow) == 0 {
+		return nil
+	}
+	existing, err := readShallow(repoPath)
+	if err != nil {
+		return err
+	}
+	shallow = append(existing, shallow...)
+	shallow = slices.DeleteFunc(shallow, func(sha string) bool {
+		return slices.Contains(unshallow, sha)
+	})
+	shallowPath := path.Join(repoPath, ".git", "shallow")
+	if len(shallow) == 0 {
+		return os.Remove(shallowPath)
+	}
+	slices.Sort(shallow)
+	shallow = slices.Compact(shallow)
+	return os.WriteFile(shallowPath, []byte(strings.Join(shallow, "\n")+"\n"), 0644)
+}
+
+// FetchResponse is what the server answered to a fetch request: the
+// commits it acknowledged as common, whether it is ready to send the pack,
+// the commits that become or stop being shallow and the pack, which is nil
+// when the server wants another round of haves.
+type FetchResponse struct {
+	acks      []string
+	ready     bool
+	shallow   []string
+	unshallow []string
+	pack      io.Reader
+}
+
+// requestPackV0 sends req to a v0 server and reads the response up to the
+// start of the pack.
+func requestPackV0(gitUrl string, server Capabilities, req *FetchRequest) (*http.Response, *FetchResponse, error) {
+	capabilities, err := req.capabilities(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := bytes.NewBuffer([]byte{})
+	for i, want := range req.wants {
+		if i == 0 && len(capabilities) > 0 {
+			buf.WriteString(packetLine(fmt.Sprintf("want %s %s\n", want, strings.Join(capabilities, " "))))
+		} else {
+			buf.WriteString(packetLine(fmt.Sprintf("want %s\n", want)))
+		}
+	}
+	for _, sha := range req.shallow {
+		buf.WriteString(packetLine(fmt.Sprintf("shallow %s\n", sha)))
+	}
+	if req.depth > 0 {
+		buf.WriteString(packetLine(fmt.Sprintf("deepen %d\n", req.depth)))
+	}
+	if req.filter != "" {
+		buf.WriteString(packetLine(fmt.Sprintf("filter %s\n", req.filter)))
+	}
+	buf.WriteString(flushPacket)
+	for _, have := range req.haves {
+		buf.WriteString(packetLine(fmt.Sprintf("have %s\n", have)))
+	}
+	if req.done {
+		buf.WriteString(packetLine("done\n"))
+	} else {
+		buf.WriteString(flushPacket)
+	}
+
+	resp, err := postService(gitUrl, "git-upload-pack", 0, buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(resp.Body)
+	fetched := &FetchResponse{}
+
+	// a shallow request is answered with the new shallow boundary first
+	if req.depth > 0 || len(req.shallow) > 0 {
+		for {
+			line, err := readPacketLine(reader)
+			if err != nil {
+				resp.Body.Close()
+				return nil, nil, err
+			}
+			if len(line) == 0 {
+				break
+			}
+			kind, sha, _ := strings.Cut(strings.TrimSuffix(string(line), "\n"), " ")
+			switch kind {
+			case "shallow":
+				fetched.shallow = append(fetched.shallow, sha)
+			case "unshallow":
+				fetched.unshallow = append(fetched.unshallow, sha)
+			}
+		}
+	}
+	if fetched.acks, fetched.ready, err = readAcknowledgments(reader); err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	if !req.done {
+		return resp, fetched, nil
+	}
+	fetched.pack = reader
+	if slices.Contains(capabilities, "side-band-64k") || slices.Contains(capabilities, "side-band") {
+		fetched.pack = &sideBandReader{reader: reader, progress: req.progress}
+	}
+	return resp, fetched, nil
+}
+
+// requestPackV2 sends req as a v2 fetch command and reads the response
+// sections up to the start of the packfile section.
+func requestPackV2(gitUrl string, server Capabilities, req *FetchRequest) (*http.Response, *FetchResponse, error) {
+	features := parseCapabilities(server.value("fetch"))
+	required := []string{}
+	if req.depth > 0 || len(req.shallow) > 0 {
+		required = append(required, "shallow")
+	}
+	if req.filter != "" {
+		required = append(required, "filter")
+	}
+	if _, err := negotiateCapabilities(features, nil, required); err != nil {
+		return nil, nil, err
+	}
+	args := []string{"thin-pack", "ofs-delta"}
+	if req.progress == nil {
+		args = append(args, "no-progress")
+	}
+	if req.includeTags {
+		args = append(args, "include-tag")
+	}
+	for _, want := range req.wants {
+		args = append(args, "want "+want)
+	}
+	for _, sha := range req.shallow {
+		args = append(args, "shallow "+sha)
+	}
+	if req.depth > 0 {
+		args = append(args, fmt.Sprintf("deepen %d", req.depth))
+	}
+	if req.filter != "" {
+		args = append(args, "filter "+req.filter)
+	}
+	for _, have := range req.haves {
+		args = append(args, "have "+have)
+	}
+	if req.done {
+		args = append(args, "done")
+	}
+
+	resp, err := postService(gitUrl, "git-upload-pack", 2, commandV2(server, "fetch", args))
+	if err != nil {
+		return nil, nil, err
+	}
+	fetched, err := readFetchResponseV2(bufio.NewReader(resp.Body), req.progress)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return resp, fetched, nil
+}
+
+// readFetchResponseV2 reads the sections of a v2 fetch response. The
+// packfile section is always the last one and is multiplexed on side-band
+// channels; the response ends after the acknowledgments section when the
+// server needs more haves.
+func readFetchResponseV2(reader *bufio.Reader, progress io.Writer) (*FetchResponse, error) {
+	fetched := &FetchResponse{}
+	for {
+		header, kind, err := readPacket(reader)
+		if err != nil {
+			return nil, err
+		}
+		if kind == flushPacket {
+			return fetched, nil
+		}
+		if kind != "" {
+			return nil, fmt.Errorf("unexpected special packet %s in fetch response", kind)
+		}
+		section := strings.TrimSuffix(string(header), "\n")
+		if section == "packfile" {
+			fetched.pack = &sideBandReader{reader: reader, progress: progress}
+			return fetched, nil
+		}
+		for {
+			line, kind, err := readPacket(reader)
+			if err != nil {
+				return nil, err
+			}
+			if kind == flushPacket && section == "acknowledgments" {
+				return fetched, nil
+			}
+			if kind == delimPacket {
+				break
+			}
+			if kind != "" {
+				return nil, fmt.Errorf("unexpected special packet %s in %s section", kind, section)
+			}
+			fields := strings.Fields(string(line))
+			switch {
+			case section == "acknowledgments" && len(fields) == 2 && fields[0] == "ACK":
+				fetched.acks = append(fetched.acks, fields[1])
+			case section == "acknowledgments" && len(fields) == 1 && fields[0] == "ready":
+				fetched.ready = true
+			case section == "shallow-info" && len(fields) == 2 && fields[0] == "shallow":
+				fetched.shallow = append(fetched.shallow, fields[1])
+			case section == "shallow-info" && len(fields) == 2 && fields[0] == "unshallow":
+				fetched.unshallow = append(fetched.unshallow, fields[1])
+			case section == "acknowledgments" && len(fields) == 1 && fields[0] == "NAK":
+			case section == "wanted-refs" || section == "packfile-uris":
+			default:
+				return nil, fmt.Errorf("unexpected line in %s section: %q", section, line)
+			}
+		}
+	}
+}
+
+// fetchPacketFile negotiates the objects the repository lacks and streams
+// the pack the server sends for req into a temporary file under
+// .git/objects/pack. It returns the path of that file and the server's
+// response, whose shallow updates are applied once the pack is stored.
+func fetchPacketFile(repoPath, gitUrl string, adv *RefAdvertisement, req *FetchRequest) (string, *FetchResponse, error) {
+	resp, fetched, err := negotiatePack(repoPath, gitUrl, adv, req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if fetched.pack == nil {
+		return "", nil, fmt.Errorf("server did not send a pack")
+	}
+
+	packDir := path.Join(repoPath, ".git", "objects", "pack")
+	if err := os.MkdirAll(packDir, 0755); err != nil {
+		return "", nil, err
+	}
+	packFile, err := os.CreateTemp(packDir, "tmp_pack_")
+	if err != nil {
+		return "", nil, err
+	}
+	defer packFile.Close()
+	if _, err := io.Copy(packFile, fetched.pack); err != nil {
+		os.Remove(packFile.Name())
+		return "", nil, err
+	}
+	return packFile.Name(), fetched, nil
+}
+
+// fetchObjects downloads the pack for req and keeps it with its index
+// under .git/objects/pack, where NewGitObjectReader finds the objects.
+// The pack is read back from disk one delta chain at a time, so memory
+// use does not grow with the repository.
+func fetchObjects(repoPath, gitRepositoryUrl string, adv *RefAdvertisement, req *FetchRequest) error {
+	tmpPackPath, fetched, err := fetchPacketFile(repoPath, gitRepositoryUrl, adv, req)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPackPath)
+
+	if _, err := indexPack(repoPath, tmpPackPath, nil); err != nil {
+		return err
+	}
+	// a shallow boundary is only recorded once the objects behind it are
+	// stored, so a failed fetch leaves .git/shallow as it was
+	return writeShallow(repoPath, fetched.shallow, fetched.unshallow)
+}
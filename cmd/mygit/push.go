@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// pushUpdate is a ref update push asks the remote for. local is the local
+// ref the new value comes from, if any, and src the name shown for it.
+// old and new are the remote ref's value before and after the update, ""
+// when the ref does not exist. status is "up to date" or "rejected" when
+// the update is not sent, and then "ok" or "remote rejected" as the
+// remote reports it; reason explains a rejection.
+type pushUpdate struct {
+	local  string
+	src    string
+	dst    string
+	old    string
+	new    string
+	force  bool
+	forced bool
+	status string
+	reason string
+}
+
+// fetchPushAdvertisement asks the server at gitUrl for the refs
+// git-receive-pack can update. receive-pack only speaks protocol v0.
+func fetchPushAdvertisement(gitUrl string) (*RefAdvertisement, error) {
+	res, reader, line, err := getInfoRefs(gitUrl, "git-receive-pack", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return parseRefAdvertisement(reader, line)
+}
+
+// resolvePushSource resolves the source of a push refspec to an object id
+// and, when it names a ref, the full name of that ref. HEAD stands for the
+// branch it points to.
+func resolvePushSource(repoPath, src string) (sha, ref string, err error) {
+	if src == "HEAD" {
+		branch, _ := readSymbolicRef(repoPath, "HEAD")
+		sha, err := readRef(repoPath, "HEAD")
+		if err != nil {
+			return "", "", fmt.Errorf("src refspec %s does not match any", src)
+		}
+		return sha, branch, nil
+	}
+	if !isObjectSha(src) {
+		for _, candidate := range expandRefName(src) {
+			if sha, err := readRef(repoPath, candidate); err == nil {
+				return sha, candidate, nil
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return "", "", err
+			}
+		}
+	}
+	sha, err = resolveRevision(repoPath, src)
+	if err != nil {
+		return "", "", fmt.Errorf("src refspec %s does not match any", src)
+	}
+	return sha, "", nil
+}
+
+// planPushUpdate turns refspec into the update of a remote ref. A
+// destination that is not a full ref name is looked up among the remote
+// refs, or else given the namespace of the source ref.
+func planPushUpdate(repoPath string, refspec *Refspec, adv *RefAdvertisement) (*pushUpdate, error) {
+	update := &pushUpdate{force: refspec.force}
+	if refspec.src != "" {
+		sha, ref, err := resolvePushSource(repoPath, refspec.src)
+		if err != nil {
+			return nil, err
+		}
+		update.new, update.local, update.src = sha, ref, refspec.src
+		if ref != "" {
+			update.src = shortRefName(ref)
+		}
+	}
+
+	dst := refspec.dst
+	if dst == "" {
+		dst = update.local
+	}
+	if dst != "" && !strings.HasPrefix(dst, "refs/") {
+		matched := ""
+		for _, candidate := range expandRefName(dst) {
+			if adv.find(candidate) != nil {
+				matched = candidate
+				break
+			}
+		}
+		switch {
+		case matched != "":
+			dst = matched
+		case strings.HasPrefix(update.local, "refs/heads/") || refspec.src == "":
+			dst = "refs/heads/" + dst
+		case strings.HasPrefix(update.local, "refs/tags/"):
+			dst = "refs/tags/" + dst
+		default:
+			dst = ""
+		}
+	}
+	if dst == "" {
+		return nil, fmt.Errorf("the destination of %s is not a full refname (i.e., starting with \"refs/\")", refspec.src)
+	}
+	update.dst = dst
+	if ref := adv.find(dst); ref != nil {
+		update.old = ref.sha
+	}
+	if update.new == "" && update.old == "" {
+		return nil, fmt.Errorf("unable to delete '%s': remote ref does not exist", refspec.dst)
+	}
+	return update, nil
+}
+
+// checkPushUpdate rejects an update that would lose commits on the
+// remote, unless it is forced: the new value must contain the old one,
+// which must be known locally, and tags are never moved.
+func checkPushUpdate(repoPath string, update *pushUpdate) {
+	if update.old == update.new {
+		update.status = "up to date"
+		return
+	}
+	if update.old == "" || update.new == "" {
+		return
+	}
+	fastForward := false
+	if hasObject(repoPath, update.old) {
+		// tags, trees and blobs cannot fast-forward
+		fastForward, _ = isAncestor(repoPath, update.old, update.new)
+	}
+	switch {
+	case fastForward:
+	case update.force:
+		update.forced = true
+	case strings.HasPrefix(update.dst, "refs/tags/"):
+		update.status, update.reason = "rejected", "already exists"
+	case !hasObject(repoPath, update.old):
+		update.status, update.reason = "rejected", "fetch first"
+	default:
+		update.status, update.reason = "rejected", "non-fast-forward"
+	}
+}
+
+// sendPush asks git-receive-pack to apply updates and sends the pack of
+// objects the remote lacks. The status the remote reports is recorded in
+// each update; updates it does not report on keep an empty status.
+func sendPush(repoPath, gitUrl string, adv *RefAdvertisement, updates []*pushUpdate, quiet bool) error {
+	wanted := []string{"report-status", "side-band-64k", "agent"}
+	if quiet {
+		wanted = append(wanted, "quiet")
+	}
+	required := []string{}
+	for _, update := range updates {
+		if update.new == "" {
+			required = append(required, "delete-refs")
+			break
+		}
+	}
+	capabilities, err := negotiateCapabilities(adv.capabilities, wanted, required)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	tips := []string{}
+	for i, update := range updates {
+		// a missing ref is sent as the null object id
+		oldSha, newSha := update.old, update.new
+		if oldSha == "" {
+			oldSha = zeroSha
+		}
+		if newSha == "" {
+			newSha = zeroSha
+		} else {
+			tips = append(tips, newSha)
+		}
+		command := fmt.Sprintf("%s %s %s", oldSha, newSha, update.dst)
+		if i == 0 {
+			command += "\x00" + strings.Join(capabilities, " ")
+		}
+		buf.WriteString(packetLine(command + "\n"))
+	}
+	buf.WriteString(flushPacket)
+	// a push that only deletes refs has no pack
+	if len(tips) > 0 {
+		exclude := []string{}
+		for _, ref := range adv.refs {
+			exclude = append(exclude, ref.sha)
+		}
+		objects, err := listMissingObjects(repoPath, tips, exclude)
+		if err != nil {
+			return err
+		}
+		if err := writePack(buf, repoPath, objects); err != nil {
+			return err
+		}
+	}
+
+	resp, err := postService(gitUrl, "git-receive-pack", 0, buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !slices.Contains(capabilities, "report-status") {
+		for _, update := range updates {
+			update.status = "ok"
+		}
+		return nil
+	}
+	reader := bufio.NewReader(resp.Body)
+	if slices.Contains(capabilities, "side-band-64k") {
+		reader = bufio.NewReader(&sideBandReader{reader: reader, progress: os.Stderr})
+	}
+	return readPushReport(reader, updates)
+}
+
+// readPushReport reads a report-status response: "unpack ok" or the reason
+// the pack was refused, then "ok <ref>" or "ng <ref> <reason>" for every
+// update, ending with a flush packet.
+func readPushReport(reader *bufio.Reader, updates []*pushUpdate) error {
+	line, err := readPacketLine(reader)
+	if err != nil {
+		return err
+	}
+	unpackStatus, ok := strings.CutPrefix(strings.TrimSuffix(string(line), "\n"), "unpack ")
+	if !ok {
+		return fmt.Errorf("invalid report-status line %q", line)
+	}
+	for {
+		line, err := readPacketLine(reader)
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			break
+		}
+		fields := strings.SplitN(strings.TrimSuffix(string(line), "\n"), " ", 3)
+		if len(fields) < 2 || (fields[0] != "ok" && fields[0] != "ng") {
+			return fmt.Errorf("invalid report-status line %q", line)
+		}
+		for _, update := range updates {
+			if update.dst != fields[1] {
+				continue
+			}
+			update.status = "ok"
+			if fields[0] == "ng" {
+				update.status, update.reason = "remote rejected", "failed"
+				if len(fields) == 3 {
+					update.reason = fields[2]
+				}
+			}
+		}
+	}
+	if unpackStatus != "ok" {
+		return fmt.Errorf("remote unpack failed: %s", unpackStatus)
+	}
+	return nil
+}
+
+// formatPushUpdate formats the summary line of update, such as
+// "   1a2b3c4..5d6e7f8  main -> main".
+func formatPushUpdate(update *pushUpdate) string {
+	code, summary, reason := byte('!'), "", update.reason
+	switch update.status {
+	case "ok":
+		switch {
+		case update.new == "":
+			code, summary = '-', "[deleted]"
+		case update.old == "" && strings.HasPrefix(update.dst, "refs/tags/"):
+			code, summary = '*', "[new tag]"
+		case update.old == "" && strings.HasPrefix(update.dst, "refs/heads/"):
+			code, summary = '*', "[new branch]"
+		case update.old == "":
+			code, summary = '*', "[new reference]"
+		case update.forced:
+			code, summary, reason = '+', update.old[:7]+"..."+update.new[:7], "forced update"
+		default:
+			code, summary = ' ', update.old[:7]+".."+update.new[:7]
+		}
+	case "rejected":
+		summary = "[rejected]"
+	case "remote rejected":
+		summary = "[remote rejected]"
+	default:
+		summary, reason = "[remote failure]", "remote failed to report status"
+	}
+	line := fmt.Sprintf(" %c %-17s ", code, summary)
+	if update.new == "" {
+		line += shortRefName(update.dst)
+	} else {
+		line += update.src + " -> " + shortRefName(update.dst)
+	}
+	if reason != "" {
+		line += " (" + reason + ")"
+	}
+	return line
+}
+
+// pushHints explain why updates were rejected, by rejection reason.
+var pushHints = map[string]string{
+	"non-fast-forward": "hint: Updates were rejected because a pushed branch tip is behind its remote\n" +
+		"hint: counterpart. Fetch and integrate the remote changes before pushing again.\n",
+	"fetch first": "hint: Updates were rejected because the remote contains work that you do not\n" +
+		"hint: have locally. Fetch and integrate the remote changes before pushing again.\n",
+	"already exists": "hint: Updates were rejected because the tag already exists in the remote.\n",
+}
+
+func push(args []string) int {
+	force, quiet, setUpstream, deleteRefs := false, false, false, false
+	positional := []string{}
+	for _, arg := range args {
+		switch arg {
+		case "-f", "--force":
+			force = true
+		case "-q", "--quiet":
+			quiet = true
+		case "-u", "--set-upstream":
+			setUpstream = true
+		case "-d", "--delete":
+			deleteRefs = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				fmt.Fprintf(os.Stderr, "Unknown option %s\n", arg)
+				return 129
+			}
+			positional = append(positional, arg)
+		}
+	}
+
+	cfg, err := loadConfig(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		return 128
+	}
+	currentBranch, err := readSymbolicRef(".", "HEAD")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading HEAD: %s\n", err)
+		return 128
+	}
+	remoteName := "origin"
+	if len(positional) > 0 {
+		remoteName = positional[0]
+	} else if branchRemote, ok := cfg.get("branch." + strings.TrimPrefix(currentBranch, "refs/heads/") + ".remote"); ok && currentBranch != "" {
+		remoteName = branchRemote
+	}
+	gitUrl, isRemote := cfg.get("remote." + remoteName + ".url")
+	if !isRemote {
+		if !strings.Contains(remoteName, "://") {
+			fmt.Fprintf(os.Stderr, "fatal: '%s' does not appear to be a git repository\n", remoteName)
+			return 128
+		}
+		gitUrl = remoteName
+	}
+
+	specs := []string{}
+	if len(positional) > 1 {
+		specs = positional[1:]
+	}
+	switch {
+	case len(specs) == 0 && deleteRefs:
+		fmt.Fprintf(os.Stderr, "fatal: --delete doesn't make sense without any refs\n")
+		return 128
+	case len(specs) == 0 && currentBranch == "":
+		fmt.Fprintf(os.Stderr, "fatal: You are not currently on a branch.\n")
+		return 128
+	case len(specs) == 0:
+		// without refspecs the current branch goes to its namesake
+		specs = []string{currentBranch}
+	}
+	refspecs := []*Refspec{}
+	for _, spec := range specs {
+		if deleteRefs {
+			if strings.ContainsAny(spec, ":*") {
+				fmt.Fprintf(os.Stderr, "fatal: --delete only accepts plain target ref names\n")
+				return 128
+			}
+			spec = ":" + spec
+		}
+		refspec, err := parseRefspec(spec)
+		if err == nil && refspec.isGlob() {
+			err = fmt.Errorf("invalid refspec '%s': wildcards are not supported by push", spec)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+			return 128
+		}
+		refspec.force = refspec.force || force
+		refspecs = append(refspecs, refspec)
+	}
+
+	adv, err := fetchPushAdvertisement(gitUrl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading refs of %s: %s\n", gitUrl, err)
+		return 128
+	}
+	updates := []*pushUpdate{}
+	commands := []*pushUpdate{}
+	for _, refspec := range refspecs {
+		update, err := planPushUpdate(".", refspec, adv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			fmt.Fprintf(os.Stderr, "error: failed to push some refs to '%s'\n", gitUrl)
+			return 1
+		}
+		checkPushUpdate(".", update)
+		updates = append(updates, update)
+		if update.status == "" {
+			commands = append(commands, update)
+		}
+	}
+	exitCode := 0
+	if len(commands) > 0 {
+		if err := sendPush(".", gitUrl, adv, commands, quiet); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			exitCode = 1
+		}
+	}
+
+	configured := []*Refspec{}
+	if isRemote {
+		for _, spec := range cfg.getAll("remote." + remoteName + ".fetch") {
+			if refspec, err := parseRefspec(spec); err == nil && refspec.isGlob() {
+				configured = append(configured, refspec)
+			}
+		}
+	}
+	shown := []string{}
+	hints := []string{}
+	upstreams := []string{}
+	for _, update := range updates {
+		if update.status != "ok" && update.status != "up to date" {
+			exitCode = 1
+			if hint, ok := pushHints[update.reason]; ok && update.status == "rejected" && !slices.Contains(hints, hint) {
+				hints = append(hints, hint)
+			}
+		}
+		if update.status == "up to date" {
+			continue
+		}
+		if update.status != "ok" || !quiet {
+			shown = append(shown, formatPushUpdate(update))
+		}
+		if update.status != "ok" {
+			continue
+		}
+		// the remote-tracking refs follow the pushed refs
+		for _, refspec := range configured {
+			tracking, ok := refspec.match(update.dst)
+			if !ok || tracking == "" {
+				continue
+			}
+			if update.new == "" {
+				err = deleteRef(".", tracking)
+			} else {
+				err = updateRef(".", tracking, update.new)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: cannot update ref '%s': %s\n", tracking, err)
+			}
+		}
+		if setUpstream && isRemote && strings.HasPrefix(update.local, "refs/heads/") && update.new != "" {
+			branch := strings.TrimPrefix(update.local, "refs/heads/")
+			err := setConfig(".", "branch."+branch+".remote", remoteName)
+			if err == nil {
+				err = setConfig(".", "branch."+branch+".merge", update.dst)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				exitCode = 1
+			} else {
+				upstreams = append(upstreams, fmt.Sprintf("branch '%s' set up to track '%s/%s'.", branch, remoteName, shortRefName(update.dst)))
+			}
+		}
+	}
+
+	if len(shown) == 0 && exitCode == 0 && len(upstreams) == 0 {
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "Everything up-to-date\n")
+		}
+		return 0
+	}
+	if len(shown) > 0 {
+		fmt.Fprintf(os.Stderr, "To %s\n", gitUrl)
+		for _, line := range shown {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}
+	if exitCode != 0 {
+		fmt.Fprintf(os.Stderr, "error: failed to push some refs to '%s'\n", gitUrl)
+		for _, hint := range hints {
+			fmt.Fprint(os.Stderr, hint)
+		}
+	}
+	if !quiet {
+		for _, upstream := range upstreams {
+			fmt.Println(upstream)
+		}
+	}
+	return exitCode
+}
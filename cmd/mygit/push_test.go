@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// requireGit skips the test when the git command line is not installed.
+func requireGit(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+}
+
+// setGitEnv isolates git and this program from the user's configuration
+// and sets the identity used for commits.
+func setGitEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	for _, role := range []string{"AUTHOR", "COMMITTER"} {
+		t.Setenv("GIT_"+role+"_NAME", "Test")
+		t.Setenv("GIT_"+role+"_EMAIL", "test@example.com")
+	}
+}
+
+// runGit runs the git command line in dir and returns its trimmed output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newPushServer serves a bare repository that accepts pushes through git
+// http-backend and returns its URL and path. The repository refuses
+// non-fast-forward updates even when they are forced.
+func newPushServer(t *testing.T) (string, string) {
+	t.Helper()
+	requireGit(t)
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skip("git --exec-path failed")
+	}
+	backend := filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend")
+	if _, err := os.Stat(backend); err != nil {
+		t.Skip("git http-backend is not installed")
+	}
+
+	root := t.TempDir()
+	bare := filepath.Join(root, "repo.git")
+	runGit(t, root, "init", "-q", "--bare", bare)
+	runGit(t, bare, "config", "http.receivepack", "true")
+	runGit(t, bare, "config", "receive.denyNonFastForwards", "true")
+
+	server := httptest.NewServer(&cgi.Handler{
+		Path: backend,
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + root,
+			"GIT_HTTP_EXPORT_ALL=1",
+			"REMOTE_USER=test",
+			"GIT_CONFIG_NOSYSTEM=1",
+			"HOME=" + root,
+		},
+	})
+	t.Cleanup(server.Close)
+	return server.URL + "/repo.git", bare
+}
+
+// pushRefspecs pushes refspecs from the repository at repoPath to gitUrl
+// the way the push command does and returns the resulting updates.
+func pushRefspecs(t *testing.T, repoPath, gitUrl string, specs ...string) []*pushUpdate {
+	t.Helper()
+	adv, err := fetchPushAdvertisement(gitUrl)
+	if err != nil {
+		t.Fatalf("reading advertisement: %s", err)
+	}
+	updates, pending := []*pushUpdate{}, []*pushUpdate{}
+	for _, spec := range specs {
+		refspec, err := parseRefspec(spec)
+		if err != nil {
+			t.Fatalf("parsing %s: %s", spec, err)
+		}
+		update, err := planPushUpdate(repoPath, refspec, adv)
+		if err != nil {
+			t.Fatalf("planning %s: %s", spec, err)
+		}
+		checkPushUpdate(repoPath, update)
+		updates = append(updates, update)
+		if update.status == "" {
+			pending = append(pending, update)
+		}
+	}
+	if len(pending) > 0 {
+		if err := sendPush(repoPath, gitUrl, adv, pending, true); err != nil {
+			t.Fatalf("pushing %v: %s", specs, err)
+		}
+	}
+	return updates
+}
+
+// remoteRef returns the value of ref in the bare repository, or "" when
+// the ref does not exist.
+func remoteRef(t *testing.T, bare, ref string) string {
+	t.Helper()
+	out, err := exec.Command("git", "--git-dir", bare, "rev-parse", "-q", "--verify", ref).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func checkStatus(t *testing.T, update *pushUpdate, status, reason string) {
+	t.Helper()
+	if update.status != status || update.reason != reason {
+		t.Errorf("%s: got status %q (%q), want %q (%q)", update.dst, update.status, update.reason, status, reason)
+	}
+}
+
+func TestPushOverHTTP(t *testing.T) {
+	gitUrl, bare := newPushServer(t)
+	setGitEnv(t)
+
+	local := t.TempDir()
+	runGit(t, local, "init", "-q", "-b", "main")
+	commit := func(name string) string {
+		if err := os.WriteFile(filepath.Join(local, name), []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, local, "add", name)
+		runGit(t, local, "commit", "-q", "-m", name)
+		return runGit(t, local, "rev-parse", "HEAD")
+	}
+
+	first := commit("a.txt")
+	updates := pushRefspecs(t, local, gitUrl, "main")
+	checkStatus(t, updates[0], "ok", "")
+	if got := remoteRef(t, bare, "refs/heads/main"); got != first {
+		t.Fatalf("remote main is %q after the first push, want %s", got, first)
+	}
+
+	// fast-forward
+	second := commit("b.txt")
+	updates = pushRefspecs(t, local, gitUrl, "main")
+	checkStatus(t, updates[0], "ok", "")
+	if updates[0].old != first || updates[0].new != second {
+		t.Errorf("fast-forward went from %s to %s, want %s to %s", updates[0].old, updates[0].new, first, second)
+	}
+	if got := remoteRef(t, bare, "refs/heads/main"); got != second {
+		t.Fatalf("remote main is %q after the fast-forward, want %s", got, second)
+	}
+	runGit(t, bare, "fsck", "--strict")
+
+	// a non-fast-forward is rejected before it is sent, and by the remote
+	// when it is forced
+	runGit(t, local, "reset", "-q", "--hard", first)
+	diverged := commit("c.txt")
+	updates = pushRefspecs(t, local, gitUrl, "main")
+	checkStatus(t, updates[0], "rejected", "non-fast-forward")
+	updates = pushRefspecs(t, local, gitUrl, "+main")
+	checkStatus(t, updates[0], "remote rejected", "non-fast-forward")
+	if got := remoteRef(t, bare, "refs/heads/main"); got != second {
+		t.Fatalf("remote main moved to %q on a rejected push, want %s", got, second)
+	}
+
+	// new branch
+	updates = pushRefspecs(t, local, gitUrl, "main:refs/heads/topic")
+	checkStatus(t, updates[0], "ok", "")
+	if updates[0].old != "" {
+		t.Errorf("new branch had old value %s", updates[0].old)
+	}
+	if got := remoteRef(t, bare, "refs/heads/topic"); got != diverged {
+		t.Fatalf("remote topic is %q, want %s", got, diverged)
+	}
+	runGit(t, bare, "fsck", "--strict")
+
+	// delete
+	updates = pushRefspecs(t, local, gitUrl, ":topic")
+	checkStatus(t, updates[0], "ok", "")
+	if got := remoteRef(t, bare, "refs/heads/topic"); got != "" {
+		t.Fatalf("remote topic still points to %s after the delete", got)
+	}
+}
+
+func TestReadPushReport(t *testing.T) {
+	updates := []*pushUpdate{
+		{dst: "refs/heads/main"},
+		{dst: "refs/heads/topic"},
+		{dst: "refs/heads/other"},
+	}
+	response := packetLine("unpack ok\n") +
+		packetLine("ok refs/heads/main\n") +
+		packetLine("ng refs/heads/topic pre-receive hook declined\n") +
+		flushPacket
+	if err := readPushReport(bufio.NewReader(strings.NewReader(response)), updates); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, updates[0], "ok", "")
+	checkStatus(t, updates[1], "remote rejected", "pre-receive hook declined")
+	checkStatus(t, updates[2], "", "")
+
+	response = packetLine("unpack index-pack abnormal exit\n") + flushPacket
+	err := readPushReport(bufio.NewReader(strings.NewReader(response)), nil)
+	if err == nil || !strings.Contains(err.Error(), "index-pack abnormal exit") {
+		t.Errorf("got error %v for a failed unpack", err)
+	}
+}
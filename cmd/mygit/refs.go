@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const maxSymrefDepth = 5
+
+func isObjectSha(name string) bool {
+	if len(name) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// readPackedRefs returns the refs stored in .git/packed-refs.
+func readPackedRefs(repoPath string) (map[string]string, error) {
+	refs := make(map[string]string)
+	f, err := os.Open(path.Join(repoPath, ".git", "packed-refs"))
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+		sha, name, ok := strings.Cut(line, " ")
+		if ok && isObjectSha(sha) {
+			refs[name] = sha
+		}
+	}
+	return refs, scanner.Err()
+}
+
+// readRef returns the object id ref points to, following symbolic refs
+// such as HEAD. It returns an error wrapping os.ErrNotExist when the ref
+// does not exist.
+func readRef(repoPath, ref string) (string, error) {
+	name := ref
+	for depth := 0; depth < maxSymrefDepth; depth++ {
+		refPath := path.Join(repoPath, ".git", filepath.FromSlash(name))
+		contents, err := os.ReadFile(refPath)
+		if info, statErr := os.Stat(refPath); err != nil && statErr == nil && info.IsDir() {
+			// a directory such as refs/remotes/origin holds refs but is not one
+			err = os.ErrNotExist
+		}
+		if os.IsNotExist(err) {
+			packedRefs, err := readPackedRefs(repoPath)
+			if err != nil {
+				return "", err
+			}
+			if sha, ok := packedRefs[name]; ok {
+				return sha, nil
+			}
+			return "", fmt.Errorf("ref %s: %w", name, os.ErrNotExist)
+		}
+		if err != nil {
+			return "", err
+		}
+		value := strings.TrimSpace(string(contents))
+		if target, ok := strings.CutPrefix(value, "ref: "); ok {
+			name = target
+			continue
+		}
+		if !isObjectSha(value) {
+			return "", fmt.Errorf("invalid ref %s: %s", name, value)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("ref %s: too many levels of symbolic refs", ref)
+}
+
+// expandObjectPrefix returns the only object whose id starts with prefix,
+// searching loose objects and pack indexes.
+func expandObjectPrefix(repoPath, prefix string) (string, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < 4 || len(prefix) > 40 {
+		return "", fmt.Errorf("object %s: %w", prefix, os.ErrNotExist)
+	}
+	if _, err := hex.DecodeString(prefix[:len(prefix)&^1]); err != nil {
+		return "", fmt.Errorf("object %s: %w", prefix, os.ErrNotExist)
+	}
+	matches := make(map[string]bool)
+	looseDir := path.Join(repoPath, ".git", "objects", prefix[:2])
+	if dirEntries, err := os.ReadDir(looseDir); err == nil {
+		for _, dirEntry := range dirEntries {
+			if sha := prefix[:2] + dirEntry.Name(); strings.HasPrefix(sha, prefix) && isObjectSha(sha) {
+				matches[sha] = true
+			}
+		}
+	}
+	packs, err := repositoryPacks(repoPath)
+	if err != nil {
+		return "", err
+	}
+	first, _ := hex.DecodeString(prefix[:2])
+	for _, p := range packs {
+		lo := 0
+		if first[0] > 0 {
+			lo = int(p.index.fanout[first[0]-1])
+		}
+		for i := lo; i < int(p.index.fanout[first[0]]); i++ {
+			if sha := hex.EncodeToString(p.index.names[i*20 : (i+1)*20]); strings.HasPrefix(sha, prefix) {
+				matches[sha] = true
+			}
+		}
+	}
+	if len(matches) > 1 {
+		return "", fmt.Errorf("short object id %s is ambiguous", prefix)
+	}
+	for sha := range matches {
+		return sha, nil
+	}
+	return "", fmt.Errorf("object %s: %w", prefix, os.ErrNotExist)
+}
+
+// refNameRules are the full ref names a short name such as "main" may
+// stand for, in the order git tries them.
+var refNameRules = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// pseudoRefs are the refs kept at the top of .git. Other names only match
+// the bare "%s" rule when they start with "refs/", so that files such as
+// .git/config are never read as refs.
+var pseudoRefs = map[string]bool{
+	"HEAD":       true,
+	"FETCH_HEAD": true,
+	"ORIG_HEAD":  true,
+	"MERGE_HEAD": true,
+}
+
+// validRefName reports whether name is well formed by the rules of git
+// check-ref-format, allowing names of a single component.
+func validRefName(name string) bool {
+	if name == "" || name == "@" || strings.HasSuffix(name, ".") ||
+		strings.Contains(name, "..") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// expandRefName returns the full ref names name may stand for, in the
+// order of refNameRules. A name that is not a valid ref name stands for
+// none.
+func expandRefName(name string) []string {
+	candidates := []string{}
+	if !validRefName(name) {
+		return candidates
+	}
+	for _, rule := range refNameRules {
+		if rule == "%s" && !pseudoRefs[name] && !strings.HasPrefix(name, "refs/") {
+			continue
+		}
+		candidates = append(candidates, fmt.Sprintf(rule, name))
+	}
+	return candidates
+}
+
+// resolveRevision turns a full or abbreviated object id or a ref name into
+// an object id, trying ref names in the same order as git. The name may be
+// followed by the suffixes ^{tree}, ^{commit}, ^, ^N and ~N.
+func resolveRevision(repoPath, rev string) (string, error) {
+	if i := strings.LastIndexAny(rev, "^~"); i > 0 {
+		sha, err := resolveRevision(repoPath, rev[:i])
+		if err != nil {
+			return "", err
+		}
+		return applyRevisionSuffix(repoPath, rev, sha, rev[i], rev[i+1:])
+	}
+	if isObjectSha(rev) {
+		return strings.ToLower(rev), nil
+	}
+	for _, candidate := range expandRefName(rev) {
+		sha, err := readRef(repoPath, candidate)
+		if err == nil {
+			return sha, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	sha, err := expandObjectPrefix(repoPath, rev)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("not a valid object name: %s", rev)
+	}
+	return sha, err
+}
+
+// applyRevisionSuffix applies the last suffix of rev, made of op and arg,
+// to the object sha the rest of rev resolved to. ^N selects the Nth parent
+// of a commit, ^0 the commit itself, and ~N follows first parents N times.
+func applyRevisionSuffix(repoPath, rev, sha string, op byte, arg string) (string, error) {
+	switch {
+	case op == '^' && arg == "{tree}":
+		return peelToTree(repoPath, sha)
+	case op == '^' && arg == "{commit}":
+		return peelToCommit(repoPath, sha)
+	}
+	n := 1
+	if arg != "" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n < 0 || arg[0] == '+' {
+			return "", fmt.Errorf("not a valid object name: %s", rev)
+		}
+	}
+	sha, err := peelToCommit(repoPath, sha)
+	if err != nil {
+		return "", err
+	}
+	if op == '^' {
+		if n == 0 {
+			return sha, nil
+		}
+		commit, err := readCommit(repoPath, sha)
+		if err != nil {
+			return "", err
+		}
+		if n > len(commit.parents) {
+			return "", fmt.Errorf("not a valid object name: %s", rev)
+		}
+		return commit.parents[n-1], nil
+	}
+	for ; n > 0; n-- {
+		commit, err := readCommit(repoPath, sha)
+		if err != nil {
+			return "", err
+		}
+		if len(commit.parents) == 0 {
+			return "", fmt.Errorf("not a valid object name: %s", rev)
+		}
+		sha = commit.parents[0]
+	}
+	return sha, nil
+}
+
+// peelToTree follows tags and commits starting at sha until it reaches a
+// tree and returns the id of that tree.
+func peelToTree(repoPath, sha string) (string, error) {
+	for {
+		objReader, err := NewGitObjectReader(repoPath, sha)
+		if err != nil {
+			return "", err
+		}
+		if objReader.Type == "tree" {
+			objReader.Close()
+			return sha, nil
+		}
+		if objReader.Type != "commit" && objReader.Type != "tag" {
+			objReader.Close()
+			return "", fmt.Errorf("object %s is a %s, not a tree", sha, objReader.Type)
+		}
+		contents, err := objReader.ReadContents()
+		objReader.Close()
+		if err != nil {
+			return "", err
+		}
+		header := "tree "
+		if objReader.Type == "tag" {
+			header = "object "
+		}
+		firstLine, _, _ := bytes.Cut(contents, []byte("\n"))
+		next, ok := strings.CutPrefix(string(firstLine), header)
+		if !ok || !isObjectSha(next) {
+			return "", fmt.Errorf("invalid %s object %s", objReader.Type, sha)
+		}
+		sha = next
+	}
+}
+
+// peelToCommit follows tags starting at sha until it reaches a commit and
+// returns the id of that commit.
+func peelToCommit(repoPath, sha string) (string, error) {
+	for {
+		objReader, err := NewGitObjectReader(repoPath, sha)
+		if err != nil {
+			return "", err
+		}
+		if objReader.Type == "commit" {
+			objReader.Close()
+			return sha, nil
+		}
+		if objReader.Type != "tag" {
+			objReader.Close()
+			return "", fmt.Errorf("object %s is a %s, not a commit", sha, objReader.Type)
+		}
+		contents, err := objReader.ReadContents()
+		objReader.Close()
+		if err != nil {
+			return "", err
+		}
+		firstLine, _, _ := bytes.Cut(contents, []byte("\n"))
+		next, ok := strings.CutPrefix(string(firstLine), "object ")
+		if !ok || !isObjectSha(next) {
+			return "", fmt.Errorf("invalid tag object %s", sha)
+		}
+		sha = next
+	}
+}
+
+// readSymbolicRef returns the ref that the symbolic ref name, such as
+// HEAD, points to. It returns "" when name holds an object id, as HEAD
+// does when it is detached.
+func readSymbolicRef(repoPath, name string) (string, error) {
+	contents, err := os.ReadFile(path.Join(repoPath, ".git", filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	target, ok := strings.CutPrefix(strings.TrimSpace(string(contents)), "ref: ")
+	if !ok {
+		return "", nil
+	}
+	return target, nil
+}
+
+// updateRef points ref at sha, writing the loose ref through a lock file
+// so that readers never see a partially written ref.
+func updateRef(repoPath, ref, sha string) error {
+	refPath := path.Join(repoPath, ".git", filepath.FromSlash(ref))
+	if err := os.MkdirAll(path.Dir(refPath), 0755); err != nil {
+		return err
+	}
+	lockPath := refPath + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to lock %s: %w", ref, err)
+	}
+	_, err = lock.WriteString(sha + "\n")
+	if closeErr := lock.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	return os.Rename(lockPath, refPath)
+}
+
+// writeSymbolicRef makes name, such as HEAD, a symbolic ref to target.
+func writeSymbolicRef(repoPath, name, target string) error {
+	refPath := path.Join(repoPath, ".git", filepath.FromSlash(name))
+	if err := os.MkdirAll(path.Dir(refPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(refPath, []byte("ref: "+target+"\n"), 0644)
+}
+
+// listRefs returns the refs whose names start with prefix, such as
+// "refs/remotes/", mapped to the object ids they hold. Loose refs take
+// precedence over packed ones and symbolic refs are left out.
+func listRefs(repoPath, prefix string) (map[string]string, error) {
+	packedRefs, err := readPackedRefs(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for name, sha := range packedRefs {
+		if strings.HasPrefix(name, prefix) {
+			refs[name] = sha
+		}
+	}
+	gitDir := path.Join(repoPath, ".git")
+	err = filepath.WalkDir(filepath.Join(gitDir, "refs"), func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(gitDir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		contents, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if value := strings.TrimSpace(string(contents)); isObjectSha(value) {
+			refs[name] = value
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// deleteRef removes ref, both the loose ref and its entry in packed-refs.
+func deleteRef(repoPath, ref string) error {
+	err := os.Remove(path.Join(repoPath, ".git", filepath.FromSlash(ref)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	packedPath := path.Join(repoPath, ".git", "packed-refs")
+	contents, err := os.ReadFile(packedPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(contents), "\n")
+	kept := []string{}
+	deleted := false
+	for _, line := range lines {
+		// the peeled value of a deleted tag goes with it
+		if strings.HasPrefix(line, "^") && deleted {
+			continue
+		}
+		_, name, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		deleted = !strings.HasPrefix(line, "#") && name == ref
+		if !deleted {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return nil
+	}
+	return os.WriteFile(packedPath, []byte(strings.Join(kept, "")), 0644)
+}
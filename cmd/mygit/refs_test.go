@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestResolveRevisionMatchesGit(t *testing.T) {
+	requireGit(t)
+	setGitEnv(t)
+
+	repo := t.TempDir()
+	runGit(t, repo, "init", "-q", "-b", "main")
+	commitFile(t, repo, "a.txt", "a\n")
+	commitFile(t, repo, "b.txt", "b\n")
+	runGit(t, repo, "checkout", "-q", "-b", "topic", "HEAD~1")
+	commitFile(t, repo, "c.txt", "c\n")
+	runGit(t, repo, "checkout", "-q", "main")
+	runGit(t, repo, "merge", "-q", "--no-edit", "topic")
+	runGit(t, repo, "tag", "-a", "-m", "v1", "v1", "HEAD~1")
+
+	revs := []string{
+		"HEAD", "main", "heads/main", "refs/heads/main", "v1",
+		"HEAD^{tree}", "HEAD^{commit}", "v1^{commit}", "v1^{tree}",
+		"HEAD^", "HEAD^1", "HEAD^2", "HEAD^0", "HEAD^^", "HEAD^2^",
+		"HEAD~", "HEAD~2", "HEAD~1^{tree}", "v1~1", "main~0",
+	}
+	for _, rev := range revs {
+		want := runGit(t, repo, "rev-parse", "--verify", "-q", rev)
+		got, err := resolveRevision(repo, rev)
+		if err != nil || got != want {
+			t.Errorf("resolveRevision(%q) = %s, %v, want %s", rev, got, err, want)
+		}
+	}
+
+	// names that are not refs fall through to object names, which they
+	// are not either
+	for _, rev := range []string{
+		"config", "index", "logs/HEAD", "../config", "/etc/passwd",
+		"main..topic", "main.lock", "HEAD^3", "HEAD~5", "HEAD~x", "HEAD^{blob}",
+	} {
+		if got, err := resolveRevision(repo, rev); err == nil {
+			t.Errorf("resolveRevision(%q) = %s, want an error", rev, got)
+		}
+	}
+}
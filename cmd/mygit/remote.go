@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// guessRemoteHead returns the branch the remote HEAD points to when the
+// server does not announce it, looking for a branch at the same commit and
+// preferring preferred, or "" when no branch matches.
+func guessRemoteHead(refs []RemoteRef, preferred string) string {
+	headSha := ""
+	for _, ref := range refs {
+		if ref.name == "HEAD" {
+			headSha = ref.sha
+		}
+	}
+	match := ""
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref.name, "refs/heads/") || ref.sha != headSha {
+			continue
+		}
+		if ref.name == preferred {
+			return ref.name
+		}
+		if match == "" {
+			match = ref.name
+		}
+	}
+	return match
+}
+
+// setupRemote records the remote name with its url and default fetch
+// refspec and creates a remote-tracking ref for every advertised branch.
+// The remote-tracking HEAD points to remoteHead, the remote's default
+// branch, and localBranch is set to track its namesake on the remote;
+// either may be "".
+func setupRemote(repoPath, name, url string, refs []RemoteRef, remoteHead, localBranch string) error {
+	trackingPrefix := "refs/remotes/" + name + "/"
+	if err := setConfig(repoPath, "remote."+name+".url", url); err != nil {
+		return err
+	}
+	if err := setConfig(repoPath, "remote."+name+".fetch", "+refs/heads/*:"+trackingPrefix+"*"); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if branch, ok := strings.CutPrefix(ref.name, "refs/heads/"); ok {
+			if err := updateRef(repoPath, trackingPrefix+branch, ref.sha); err != nil {
+				return err
+			}
+		}
+	}
+
+	if remoteHead != "" {
+		if err := writeSymbolicRef(repoPath, trackingPrefix+"HEAD", trackingPrefix+strings.TrimPrefix(remoteHead, "refs/heads/")); err != nil {
+			return err
+		}
+	}
+	if localBranch == "" {
+		return nil
+	}
+	branchName := strings.TrimPrefix(localBranch, "refs/heads/")
+	if err := setConfig(repoPath, "branch."+branchName+".remote", name); err != nil {
+		return err
+	}
+	return setConfig(repoPath, "branch."+branchName+".merge", localBranch)
+}
+
+// cloneDirectory derives the directory clone creates from the repository
+// url, as in "https://host/path/repo.git" giving "repo".
+func cloneDirectory(gitUrl string) string {
+	name := strings.TrimRight(gitUrl, "/")
+	name = strings.TrimSuffix(name, "/.git")
+	name = strings.TrimSuffix(path.Base(name), ".git")
+	if name == "" || name == "." || name == "/" {
+		return "repo"
+	}
+	return name
+}
+
+func clone(args []string) int {
+	branch := ""
+	depth := 0
+	quiet := false
+	positional := []string{}
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "-b", "--branch":
+			if i+1 >= len(args) {
+				fmt.Fprintf(os.Stderr, "option %s requires a value\n", arg)
+				return 129
+			}
+			i++
+			branch = args[i]
+		case "--depth":
+			if i+1 >= len(args) {
+				fmt.Fprintf(os.Stderr, "option %s requires a value\n", arg)
+				return 129
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n <= 0 {
+				fmt.Fprintf(os.Stderr, "fatal: depth %s is not a positive number\n", args[i])
+				return 128
+			}
+			depth = n
+		case "-q", "--quiet":
+			quiet = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				fmt.Fprintf(os.Stderr, "Unknown option %s\n", arg)
+				return 129
+			}
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 || len(positional) > 2 {
+		fmt.Fprintf(os.Stderr, "usage: mygit clone [-q] [-b <branch>] [--depth <depth>] <repository> [<directory>]\n")
+		return 129
+	}
+	gitUrl := positional[0]
+	dir := cloneDirectory(gitUrl)
+	if len(positional) == 2 {
+		dir = positional[1]
+	}
+	repoPath := path.Clean(dir)
+	if items, err := os.ReadDir(repoPath); err == nil && len(items) > 0 {
+		fmt.Fprintf(os.Stderr, "fatal: destination path '%s' already exists and is not an empty directory.\n", dir)
+		return 128
+	}
+
+	adv, err := fetchRefAdvertisement(gitUrl, []string{"HEAD", "refs/heads/", "refs/tags/"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading refs of %s: %s\n", gitUrl, err)
+		return 128
+	}
+	if branch != "" && adv.find("refs/heads/"+branch) == nil && adv.find("refs/tags/"+branch) == nil {
+		fmt.Fprintf(os.Stderr, "fatal: Remote branch %s not found in upstream origin\n", branch)
+		return 128
+	}
+	if err := os.MkdirAll(repoPath, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating %s: %s\n", dir, err)
+		return 128
+	}
+	if err := initGitRepository(repoPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing %s: %s\n", dir, err)
+		return 128
+	}
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Cloning into '%s'...\n", dir)
+	}
+
+	initialBranch, err := readSymbolicRef(repoPath, "HEAD")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading HEAD: %s\n", err)
+		return 128
+	}
+	remoteHead := adv.symref("HEAD")
+	if remoteHead == "" {
+		remoteHead = guessRemoteHead(adv.refs, initialBranch)
+	}
+
+	// HEAD ends up on a branch named after the remote one, or detached at
+	// a tag given with -b, or at the remote HEAD when no branch matches it
+	localBranch, checkoutSha := remoteHead, ""
+	switch {
+	case branch != "":
+		if ref := adv.find("refs/heads/" + branch); ref != nil {
+			localBranch, checkoutSha = ref.name, ref.sha
+			break
+		}
+		tag := adv.find("refs/tags/" + branch)
+		localBranch, checkoutSha = "", tag.sha
+		if tag.peeled != "" {
+			checkoutSha = tag.peeled
+		}
+	case remoteHead != "" && adv.find(remoteHead) != nil:
+		checkoutSha = adv.find(remoteHead).sha
+	case remoteHead != "":
+		// the remote HEAD is an unborn branch
+	case adv.find("HEAD") != nil:
+		localBranch, checkoutSha = "", adv.find("HEAD").sha
+	}
+
+	wants := []string{}
+	for _, ref := range adv.refs {
+		if (strings.HasPrefix(ref.name, "refs/heads/") || strings.HasPrefix(ref.name, "refs/tags/")) && !slices.Contains(wants, ref.sha) {
+			wants = append(wants, ref.sha)
+		}
+	}
+	if checkoutSha != "" && !slices.Contains(wants, checkoutSha) {
+		wants = append(wants, checkoutSha)
+	}
+	if len(wants) == 0 {
+		fmt.Fprintf(os.Stderr, "warning: You appear to have cloned an empty repository.\n")
+		if remoteHead != "" {
+			if err := writeSymbolicRef(repoPath, "HEAD", remoteHead); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing HEAD: %s\n", err)
+				return 128
+			}
+		}
+		if err := setupRemote(repoPath, "origin", gitUrl, nil, "", ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error configuring remote: %s\n", err)
+			return 128
+		}
+		return 0
+	}
+	req := &FetchRequest{wants: wants, depth: depth}
+	if !quiet {
+		req.progress = os.Stderr
+	}
+	if err := fetchObjects(repoPath, gitUrl, adv, req); err != nil {
+		fmt.Fprintf(os.Stderr, "Error fetching objects: %s\n", err)
+		return 128
+	}
+
+	if err := setupRemote(repoPath, "origin", gitUrl, adv.refs, remoteHead, localBranch); err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring remote: %s\n", err)
+		return 128
+	}
+	for _, ref := range adv.refs {
+		if strings.HasPrefix(ref.name, "refs/tags/") {
+			if err := updateRef(repoPath, ref.name, ref.sha); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", ref.name, err)
+				return 128
+			}
+		}
+	}
+	if localBranch != "" {
+		err = writeSymbolicRef(repoPath, "HEAD", localBranch)
+		if err == nil {
+			err = updateRef(repoPath, localBranch, checkoutSha)
+		}
+	} else if checkoutSha != "" {
+		err = updateRef(repoPath, "HEAD", checkoutSha)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing HEAD: %s\n", err)
+		return 128
+	}
+	if checkoutSha == "" {
+		fmt.Fprintf(os.Stderr, "warning: remote HEAD refers to nonexistent ref, unable to checkout\n")
+		return 0
+	}
+	if err := restoreRepository(repoPath, checkoutSha); err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking out %s: %s\n", checkoutSha, err)
+		return 128
+	}
+	return 0
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const zeroSha = "0000000000000000000000000000000000000000"
+
+// StatusEntry describes how a tracked path differs between the HEAD tree,
+// the index and the working tree. staged and unstaged hold the porcelain
+// status letters, with ' ' meaning unchanged.
+type StatusEntry struct {
+	path         string
+	staged       byte
+	unstaged     byte
+	headMode     uint32
+	indexMode    uint32
+	worktreeMode uint32
+	headSha      string
+	indexSha     string
+	stages       [4]*IndexEntry
+}
+
+// unmerged reports whether the path has conflicting stages in the index.
+func (e *StatusEntry) unmerged() bool {
+	return e.stages != [4]*IndexEntry{}
+}
+
+// unmergedStatus maps the stages an unmerged path has, as a bit mask of
+// 1 for the base, 2 for ours and 4 for theirs, to its status letters.
+var unmergedStatus = map[int]string{
+	1: "DD",
+	2: "AU",
+	3: "UD",
+	4: "UA",
+	5: "DU",
+	6: "AA",
+	7: "UU",
+}
+
+// Status is the result of comparing HEAD, the index and the working tree.
+type Status struct {
+	branch    string
+	headSha   string
+	entries   []*StatusEntry
+	untracked []string
+}
+
+// flattenTree records every non-tree entry below treeSha in files, keyed
+// by its full path.
+func flattenTree(repoPath, treeSha, prefix string, files map[string]TreeChild) error {
+	treeBuf, err := readObjectContent(repoPath, treeSha)
+	if err != nil {
+		return err
+	}
+	tree, err := parseTree(treeBuf)
+	if err != nil {
+		return err
+	}
+	for _, child := range tree.children {
+		if treeEntryType(child.mode) == "tree" {
+			if err := flattenTree(repoPath, child.sha, prefix+child.name+"/", files); err != nil {
+				return err
+			}
+			continue
+		}
+		files[prefix+child.name] = child
+	}
+	return nil
+}
+
+func parseMode(mode string) uint32 {
+	m, _ := strconv.ParseUint(mode, 8, 32)
+	return uint32(m)
+}
+
+// modeChangeLetter returns 'T' when the two modes are of a different kind
+// of object (file, symlink or gitlink) and 'M' otherwise.
+func modeChangeLetter(from, to uint32) byte {
+	if from&0170000 != to&0170000 {
+		return 'T'
+	}
+	return 'M'
+}
+
+// computeStatus compares HEAD, the index and the working tree of
+// repoPath. Index entries whose stat data is stale but whose contents are
+// unchanged are refreshed and the index is written back when possible.
+func computeStatus(repoPath string) (*Status, error) {
+	status := &Status{}
+	headRef, err := readSymbolicRef(repoPath, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	status.branch = strings.TrimPrefix(headRef, "refs/heads/")
+	headFiles := make(map[string]TreeChild)
+	status.headSha, err = readRef(repoPath, "HEAD")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if status.headSha != "" {
+		treeSha, err := peelToTree(repoPath, status.headSha)
+		if err != nil {
+			return nil, err
+		}
+		if err := flattenTree(repoPath, treeSha, "", headFiles); err != nil {
+			return nil, err
+		}
+	}
+
+	idx, err := readIndex(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]*StatusEntry)
+	get := func(name string) *StatusEntry {
+		if entry, ok := byPath[name]; ok {
+			return entry
+		}
+		entry := &StatusEntry{path: name, staged: ' ', unstaged: ' ', headSha: zeroSha, indexSha: zeroSha}
+		if child, ok := headFiles[name]; ok {
+			entry.headMode = parseMode(child.mode)
+			entry.headSha = child.sha
+		}
+		byPath[name] = entry
+		return entry
+	}
+
+	refreshed := false
+	for _, indexEntry := range idx.entries {
+		if indexEntry.stage() != 0 {
+			entry := get(indexEntry.name)
+			entry.stages[indexEntry.stage()] = indexEntry
+			continue
+		}
+		entry := get(indexEntry.name)
+		entry.worktreeMode = indexEntry.mode
+		if indexEntry.extendedFlags&indexFlagIntentToAdd != 0 {
+			// intent-to-add entries only record that the path will be added
+			entry.unstaged = 'A'
+			continue
+		}
+		entry.indexMode = indexEntry.mode
+		entry.indexSha = indexEntry.sha
+
+		if _, ok := headFiles[indexEntry.name]; !ok {
+			entry.staged = 'A'
+		} else if entry.headSha != entry.indexSha || entry.headMode != entry.indexMode {
+			entry.staged = modeChangeLetter(entry.headMode, entry.indexMode)
+		}
+
+		changed, err := worktreeChanged(repoPath, indexEntry, entry)
+		if err != nil {
+			return nil, err
+		}
+		if !changed && entryChanged(indexEntry, indexEntry.name) && indexEntry.mode != indexModeGitlink {
+			if info, err := os.Lstat(filepath.Join(repoPath, filepath.FromSlash(indexEntry.name))); err == nil {
+				fillStatData(indexEntry, info)
+				refreshed = true
+			}
+		}
+	}
+	for name := range headFiles {
+		if _, ok := byPath[name]; !ok {
+			entry := get(name)
+			entry.staged = 'D'
+		}
+	}
+	for _, entry := range byPath {
+		if entry.unmerged() {
+			if err := unmergedChanges(repoPath, entry); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if refreshed {
+		// like git, failing to refresh the index is not an error
+		idx.write(repoPath)
+	}
+
+	for _, entry := range byPath {
+		if entry.staged != ' ' || entry.unstaged != ' ' {
+			status.entries = append(status.entries, entry)
+		}
+	}
+	sort.Slice(status.entries, func(i, j int) bool {
+		return status.entries[i].path < status.entries[j].path
+	})
+	status.untracked, err = collectUntracked(repoPath, idx)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// worktreeChanged compares the working tree file of indexEntry with the
+// index and records the result in entry. Files whose stat data matches
+// the index are not hashed again.
+func worktreeChanged(repoPath string, indexEntry *IndexEntry, entry *StatusEntry) (bool, error) {
+	filePath := filepath.Join(repoPath, filepath.FromSlash(indexEntry.name))
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) || (err == nil && info.IsDir() && indexEntry.mode != indexModeGitlink) {
+		entry.unstaged = 'D'
+		entry.worktreeMode = 0
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if indexEntry.mode == indexModeGitlink {
+		commitSha, err := readRef(filePath, "HEAD")
+		if err != nil || commitSha != indexEntry.sha {
+			entry.unstaged = 'M'
+			return true, nil
+		}
+		return false, nil
+	}
+	if !entryChanged(indexEntry, indexEntry.name) {
+		return false, nil
+	}
+	current, err := newIndexEntry(repoPath, indexEntry.name, false)
+	if err != nil {
+		return false, err
+	}
+	entry.worktreeMode = current.mode
+	if current.sha == indexEntry.sha && current.mode == indexEntry.mode {
+		return false, nil
+	}
+	entry.unstaged = modeChangeLetter(indexEntry.mode, current.mode)
+	return true, nil
+}
+
+// unmergedChanges sets the status letters of an unmerged entry from the
+// stages it has and its working tree mode the way worktreeChanged does.
+func unmergedChanges(repoPath string, entry *StatusEntry) error {
+	mask := 0
+	for stage := 1; stage <= 3; stage++ {
+		if entry.stages[stage] != nil {
+			mask |= 1 << (stage - 1)
+		}
+	}
+	letters := unmergedStatus[mask]
+	entry.staged, entry.unstaged = letters[0], letters[1]
+	current, err := newIndexEntry(repoPath, entry.path, false)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entry.worktreeMode = current.mode
+	return nil
+}
+
+// collectUntracked lists the working tree paths that are neither in the
+// index nor ignored. A directory without any tracked path is reported once
+// as "dir/", and only when it contains at least one file that is not
+// ignored.
+func collectUntracked(repoPath string, idx *Index) ([]string, error) {
+	matcher, err := newIgnoreMatcher(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]bool)
+	trackedDirs := make(map[string]bool)
+	for _, entry := range idx.entries {
+		tracked[entry.name] = true
+		for dir := filepath.ToSlash(filepath.Dir(entry.name)); dir != "."; dir = filepath.ToSlash(filepath.Dir(dir)) {
+			trackedDirs[dir] = true
+		}
+	}
+
+	untracked := []string{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		items, err := os.ReadDir(filepath.Join(repoPath, filepath.FromSlash(dir)))
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if item.Name() == ".git" {
+				continue
+			}
+			name := item.Name()
+			if dir != "" {
+				name = dir + "/" + item.Name()
+			}
+			if tracked[name] {
+				continue
+			}
+			if !trackedDirs[name] && matcher.isIgnored(name, item.IsDir()) {
+				continue
+			}
+			if !item.IsDir() {
+				untracked = append(untracked, name)
+				continue
+			}
+			if trackedDirs[name] {
+				if err := walk(name); err != nil {
+					return err
+				}
+				continue
+			}
+			hasFiles, err := containsFiles(repoPath, name, matcher)
+			if err != nil {
+				return err
+			}
+			if hasFiles {
+				untracked = append(untracked, name+"/")
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return untracked, nil
+}
+
+// containsFiles reports whether dir holds any file that is not ignored, or
+// is itself a nested repository, so that empty untracked directories are
+// not shown.
+func containsFiles(repoPath, dir string, matcher *IgnoreMatcher) (bool, error) {
+	found := errors.New("found")
+	root := filepath.Join(repoPath, filepath.FromSlash(dir))
+	err := filepath.WalkDir(root, func(walkPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Name() == ".git" {
+			return found
+		}
+		if walkPath == root {
+			return nil
+		}
+		rel, err := filepath.Rel(repoPath, walkPath)
+		if err != nil {
+			return err
+		}
+		if matcher.isIgnored(filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return found
+		}
+		return nil
+	})
+	if err == found {
+		return true, nil
+	}
+	return false, err
+}
+
+var statusLabels = map[byte]string{
+	'A': "new file:",
+	'M': "modified:",
+	'D': "deleted:",
+	'T': "typechange:",
+}
+
+var unmergedLabels = map[string]string{
+	"DD": "both deleted:",
+	"AU": "added by us:",
+	"UD": "deleted by them:",
+	"UA": "added by them:",
+	"DU": "deleted by us:",
+	"AA": "both added:",
+	"UU": "both modified:",
+}
+
+func (s *Status) printLong(writer *bufio.Writer) {
+	if s.branch != "" {
+		fmt.Fprintf(writer, "On branch %s\n", s.branch)
+	} else {
+		fmt.Fprintf(writer, "HEAD detached at %s\n", s.headSha[:7])
+	}
+	if s.headSha == "" {
+		fmt.Fprintf(writer, "\nNo commits yet\n\n")
+	}
+
+	section := func(title string, hints []string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(writer, "%s\n", title)
+		for _, hint := range hints {
+			fmt.Fprintf(writer, "  (%s)\n", hint)
+		}
+		for _, line := range lines {
+			fmt.Fprintf(writer, "\t%s\n", line)
+		}
+		fmt.Fprintln(writer)
+	}
+	unmerged, staged, unstaged := []string{}, []string{}, []string{}
+	for _, entry := range s.entries {
+		if entry.unmerged() {
+			label := unmergedLabels[string([]byte{entry.staged, entry.unstaged})]
+			unmerged = append(unmerged, fmt.Sprintf("%-16s%s", label, entry.path))
+			continue
+		}
+		if entry.staged != ' ' {
+			staged = append(staged, fmt.Sprintf("%-12s%s", statusLabels[entry.staged], entry.path))
+		}
+		if entry.unstaged != ' ' && entry.unstaged != 'A' {
+			unstaged = append(unstaged, fmt.Sprintf("%-12s%s", statusLabels[entry.unstaged], entry.path))
+		}
+	}
+	section("Unmerged paths:", []string{`use "mygit add <file>..." to mark resolution`}, unmerged)
+	section("Changes to be committed:", nil, staged)
+	section("Changes not staged for commit:", []string{`use "mygit add <file>..." to update what will be committed`}, unstaged)
+	section("Untracked files:", []string{`use "mygit add <file>..." to include in what will be committed`}, s.untracked)
+
+	switch {
+	case len(staged) > 0 || len(unmerged) > 0:
+	case len(unstaged) > 0:
+		fmt.Fprintf(writer, "no changes added to commit (use \"mygit add\")\n")
+	case len(s.untracked) > 0:
+		fmt.Fprintf(writer, "nothing added to commit but untracked files present (use \"mygit add\" to track)\n")
+	case s.headSha == "":
+		fmt.Fprintf(writer, "nothing to commit (create/copy files and use \"mygit add\" to track)\n")
+	default:
+		fmt.Fprintf(writer, "nothing to commit, working tree clean\n")
+	}
+}
+
+func (s *Status) printPorcelainV1(writer *bufio.Writer, showBranch bool) {
+	if showBranch {
+		switch {
+		case s.branch == "":
+			fmt.Fprintf(writer, "## HEAD (no branch)\n")
+		case s.headSha == "":
+			fmt.Fprintf(writer, "## No commits yet on %s\n", s.branch)
+		default:
+			fmt.Fprintf(writer, "## %s\n", s.branch)
+		}
+	}
+	for _, entry := range s.entries {
+		fmt.Fprintf(writer, "%c%c %s\n", entry.staged, entry.unstaged, entry.path)
+	}
+	for _, name := range s.untracked {
+		fmt.Fprintf(writer, "?? %s\n", name)
+	}
+}
+
+func (s *Status) printPorcelainV2(writer *bufio.Writer, showBranch bool) {
+	if showBranch {
+		if s.headSha == "" {
+			fmt.Fprintf(writer, "# branch.oid (initial)\n")
+		} else {
+			fmt.Fprintf(writer, "# branch.oid %s\n", s.headSha)
+		}
+		if s.branch == "" {
+			fmt.Fprintf(writer, "# branch.head (detached)\n")
+		} else {
+			fmt.Fprintf(writer, "# branch.head %s\n", s.branch)
+		}
+	}
+	letter := func(b byte) byte {
+		if b == ' ' {
+			return '.'
+		}
+		return b
+	}
+	submodule := func(entry *StatusEntry) string {
+		if entry.indexMode != indexModeGitlink && entry.headMode != indexModeGitlink {
+			return "N..."
+		}
+		if entry.unstaged == 'M' {
+			return "SC.."
+		}
+		return "S..."
+	}
+	for _, entry := range s.entries {
+		if entry.unmerged() {
+			modes, shas := [4]uint32{}, [4]string{zeroSha, zeroSha, zeroSha, zeroSha}
+			for stage := 1; stage <= 3; stage++ {
+				if stageEntry := entry.stages[stage]; stageEntry != nil {
+					modes[stage], shas[stage] = stageEntry.mode, stageEntry.sha
+				}
+			}
+			fmt.Fprintf(writer, "u %c%c N... %06o %06o %06o %06o %s %s %s %s\n",
+				entry.staged, entry.unstaged, modes[1], modes[2], modes[3], entry.worktreeMode,
+				shas[1], shas[2], shas[3], entry.path)
+			continue
+		}
+		fmt.Fprintf(writer, "1 %c%c %s %06o %06o %06o %s %s %s\n",
+			letter(entry.staged), letter(entry.unstaged), submodule(entry),
+			entry.headMode, entry.indexMode, entry.worktreeMode, entry.headSha, entry.indexSha, entry.path)
+	}
+	for _, name := range s.untracked {
+		fmt.Fprintf(writer, "? %s\n", name)
+	}
+}
+
+func status(args []string) int {
+	format, showBranch := "long", false
+	for _, arg := range args {
+		switch arg {
+		case "--long":
+			format = "long"
+		case "-s", "--short", "--porcelain", "--porcelain=v1", "--porcelain=1":
+			format = "v1"
+		case "--porcelain=v2", "--porcelain=2":
+			format = "v2"
+		case "-b", "--branch":
+			showBranch = true
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown option %s\n", arg)
+			return 1
+		}
+	}
+	s, err := computeStatus(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+	switch format {
+	case "v1":
+		s.printPorcelainV1(writer, showBranch)
+	case "v2":
+		s.printPorcelainV2(writer, showBranch)
+	default:
+		s.printLong(writer)
+	}
+	return 0
+}
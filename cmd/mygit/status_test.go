@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnmergedStatusMatchesGit(t *testing.T) {
+	requireGit(t)
+	setGitEnv(t)
+
+	repo := t.TempDir()
+	runGit(t, repo, "init", "-q", "-b", "main")
+	commitFile(t, repo, "base.txt", "base\n")
+	blob := func(contents string) string {
+		return strings.TrimSpace(string(runGitInput(t, repo, contents, "hash-object", "-w", "--stdin")))
+	}
+	base, ours, theirs := blob("base\n"), blob("ours\n"), blob("theirs\n")
+
+	// each path has the stages named by its status letters, and some have
+	// a working tree file, one of them executable
+	stages := map[string][]int{
+		"dd.txt": {1},
+		"au.txt": {2},
+		"ud.txt": {1, 2},
+		"ua.txt": {3},
+		"du.txt": {1, 3},
+		"aa.txt": {2, 3},
+		"uu.txt": {1, 2, 3},
+	}
+	var indexInfo strings.Builder
+	for name, present := range stages {
+		for _, stage := range present {
+			sha := []string{"", base, ours, theirs}[stage]
+			fmt.Fprintf(&indexInfo, "100644 %s %d\t%s\n", sha, stage, name)
+		}
+	}
+	runGitInput(t, repo, indexInfo.String(), "update-index", "--index-info")
+	for name, mode := range map[string]os.FileMode{"uu.txt": 0644, "aa.txt": 0755, "ud.txt": 0644} {
+		if err := os.WriteFile(filepath.Join(repo, name), []byte("conflict\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, err := computeStatus(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{"v1", "v2"} {
+		var out bytes.Buffer
+		writer := bufio.NewWriter(&out)
+		if format == "v1" {
+			status.printPorcelainV1(writer, false)
+		} else {
+			status.printPorcelainV2(writer, false)
+		}
+		writer.Flush()
+		want := runGit(t, repo, "status", "--porcelain="+format, "--untracked-files=no")
+		if got := strings.TrimSpace(out.String()); got != want {
+			t.Errorf("porcelain %s status:\n%s\nwant:\n%s", format, got, want)
+		}
+	}
+}